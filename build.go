@@ -9,6 +9,7 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"flag"
@@ -16,11 +17,11 @@ import (
 	"io/fs"
 	"log"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 
 	"go.astrophena.name/site"
+	"go.astrophena.name/site/internal/wasm"
 	"go.astrophena.name/site/vanity"
 )
 
@@ -28,27 +29,50 @@ func main() {
 	log.SetFlags(0)
 
 	var (
-		prodFlag     = flag.Bool("prod", false, "Build in a production mode.")
-		skipStarplay = flag.Bool("skip-starplay", false, "Skip building Starlark playground WASM module.")
-		vanityFlag   = flag.Bool("vanity", false, "Build vanity import site instead of main one.")
+		chdirFlag       = flag.String("C", "", "Change to `dir` before running, instead of requiring to run from repo root.")
+		prodFlag        = flag.Bool("prod", false, "Build in a production mode.")
+		deployFlag      = flag.Bool("deploy", false, "Warn if the build isn't suitable for deploying.")
+		skipStarplay    = flag.Bool("skip-starplay", false, "Skip building Starlark playground WASM module.")
+		vanityFlag      = flag.Bool("vanity", false, "Build vanity import site instead of main one.")
+		reposFile       = flag.String("repos-file", "", "Read repositories for vanity import site from `file` instead of GitHub API.")
+		providerFlag    = flag.String("provider", "github", "Discover repositories for vanity import site on `service`: github or gitlab.")
+		archivedFlag    = flag.Bool("include-archived", false, "Include archived repositories in vanity import site.")
+		cacheDir        = flag.String("cache-dir", "", "Cache GitHub API responses for vanity import site in `dir` between builds.")
+		concurrencyFlag = flag.Int("j", 0, "Run at most `n` build jobs in parallel (0 means the number of CPUs).")
+		strictFlag      = flag.Bool("strict-front-matter", false, "Fail on unknown front matter fields.")
+		verifyFlag      = flag.Bool("verify-output", false, "Check built HTML and internal links after the build.")
 	)
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: ./build.go [flags] [dir]\n")
 		fmt.Fprintf(os.Stderr, "Available flags:\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "SITE_SRC, SITE_DST and SITE_BASE_URL environment variables override defaults, flags override them.\n")
 	}
 	flag.Parse()
 
-	wd := try(os.Getwd())
-	if _, err := os.Stat(filepath.Join(wd, "go.mod")); errors.Is(err, fs.ErrNotExist) {
-		log.Fatal("Are you at repo root?")
-	} else if err != nil {
-		log.Fatal(err)
+	if *chdirFlag != "" {
+		must(os.Chdir(*chdirFlag))
 	}
 
-	dir := filepath.Join(".", "build")
+	// Flags take precedence over environment variables.
+	c := &site.Config{
+		Prod:              *prodFlag,
+		Deploy:            *deployFlag,
+		Concurrency:       *concurrencyFlag,
+		StrictFrontMatter: *strictFlag,
+		VerifyOutput:      *verifyFlag,
+	}
+	must(c.ApplyEnv(os.Getenv))
 	if len(flag.Args()) > 0 {
-		dir = flag.Args()[0]
+		c.Dst = flag.Args()[0]
+	}
+
+	// Site sources are at repo root, unless SITE_SRC points elsewhere.
+	src := cmp.Or(c.Src, ".")
+	if _, err := os.Stat(filepath.Join(src, "go.mod")); errors.Is(err, fs.ErrNotExist) {
+		log.Fatal("Are you at repo root, or does SITE_SRC point to it?")
+	} else if err != nil {
+		log.Fatal(err)
 	}
 
 	if *vanityFlag {
@@ -56,34 +80,31 @@ func main() {
 		defer cancel()
 
 		must(vanity.Build(ctx, &vanity.Config{
-			Dir:         dir,
-			GitHubToken: os.Getenv("GITHUB_TOKEN"),
-			ImportRoot:  "go.astrophena.name",
+			Dir:             cmp.Or(c.Dst, filepath.Join(".", "build")),
+			Provider:        *providerFlag,
+			GitHubToken:     os.Getenv("GITHUB_TOKEN"),
+			GitLabToken:     os.Getenv("GITLAB_TOKEN"),
+			ImportRoot:      "go.astrophena.name",
+			ReposFile:       *reposFile,
+			CacheDir:        *cacheDir,
+			IncludeArchived: *archivedFlag,
+			Concurrency:     *concurrencyFlag,
 		}))
 
 		return
 	}
 
 	if !*skipStarplay {
-		build := exec.Command("go", "build", "-o", filepath.Join("static", "wasm", "starplay.wasm"), "./starplay")
-		build.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
-		build.Stderr = os.Stderr
-		must(build.Run())
+		must(wasm.Build(
+			filepath.Join(src, "starplay"),
+			filepath.Join(src, "static", "wasm", "starplay.wasm"),
+			filepath.Join(src, "static", "js", "go_wasm_exec.js"),
+		))
 	}
 
-	c := &site.Config{
-		Src:  ".",
-		Dst:  dir,
-		Prod: *prodFlag,
-	}
 	must(site.Build(c))
 }
 
-func try[T any](val T, err error) T {
-	must(err)
-	return val
-}
-
 func must(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -3,11 +3,15 @@ module go.astrophena.name/site
 go 1.23
 
 require (
+	github.com/andybalholm/brotli v1.2.5
 	github.com/fsnotify/fsnotify v1.8.0
 	github.com/gorilla/feeds v1.2.0
+	github.com/tdewolff/minify/v2 v2.23.1
 	go.abhg.dev/doc2go v0.8.2-0.20240626042920-4345d7c36b95
 	go.astrophena.name/base v0.2.0
 	go.starlark.net v0.0.0-20240925182052-1207426daebd
+	golang.org/x/image v0.23.0
+	golang.org/x/sync v0.10.0
 	rsc.io/markdown v0.0.0-20240717201619-868a055c40ae
 )
 
@@ -18,9 +22,9 @@ require (
 	github.com/fluhus/godoc-tricks v1.5.0 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/peterbourgon/ff/v3 v3.4.0 // indirect
+	github.com/tdewolff/parse/v2 v2.7.23 // indirect
 	golang.org/x/mod v0.20.0 // indirect
-	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/sys v0.24.0 // indirect
-	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 	golang.org/x/tools v0.24.0 // indirect
 )
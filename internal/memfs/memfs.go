@@ -0,0 +1,185 @@
+// © 2022 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the ISC
+// license that can be found in the LICENSE file.
+
+// Package memfs implements an in-memory file system that is safe for
+// concurrent use.
+package memfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS is an in-memory file system. Directories are implied by the files they
+// contain. The zero value is an empty file system ready to use.
+type FS struct {
+	mu    sync.RWMutex
+	files map[string]*file
+}
+
+type file struct {
+	data    []byte
+	modTime time.Time
+}
+
+// WriteFile creates or replaces the file name with data. Name must be a
+// valid slash-separated path as defined by fs.ValidPath.
+func (m *FS) WriteFile(name string, data []byte, modTime time.Time) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = make(map[string]*file)
+	}
+	m.files[name] = &file{data: data, modTime: modTime}
+	return nil
+}
+
+// Open implements fs.FS.
+func (m *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if f, ok := m.files[name]; ok {
+		return &openFile{
+			info:   fileInfo{name: path.Base(name), size: int64(len(f.data)), modTime: f.modTime},
+			Reader: bytes.NewReader(f.data),
+		}, nil
+	}
+
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	children := make(map[string]fileInfo)
+	for fname, f := range m.files {
+		rest, ok := strings.CutPrefix(fname, prefix)
+		if !ok {
+			continue
+		}
+		if elem, _, isDir := strings.Cut(rest, "/"); isDir {
+			children[elem] = fileInfo{name: elem, mode: fs.ModeDir | 0o755}
+		} else {
+			children[elem] = fileInfo{name: elem, size: int64(len(f.data)), modTime: f.modTime}
+		}
+	}
+	if len(children) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, fi := range children {
+		entries = append(entries, fi)
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return &openDir{
+		info:    fileInfo{name: path.Base(name), mode: fs.ModeDir | 0o755},
+		entries: entries,
+	}, nil
+}
+
+// fileInfo implements both fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.mode == 0 {
+		return 0o644
+	}
+	return fi.mode
+}
+
+func (fi fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi fileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+func (fi fileInfo) Sys() any {
+	return nil
+}
+
+func (fi fileInfo) Type() fs.FileMode {
+	return fi.Mode().Type()
+}
+
+func (fi fileInfo) Info() (fs.FileInfo, error) {
+	return fi, nil
+}
+
+func (fi fileInfo) String() string {
+	return fs.FormatDirEntry(fi)
+}
+
+// openFile is an open regular file. Seeking and ReadAt are supported, as
+// net/http needs them to serve content.
+type openFile struct {
+	info fileInfo
+	*bytes.Reader
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *openFile) Close() error {
+	return nil
+}
+
+// openDir is an open directory with its entries read when it was opened.
+type openDir struct {
+	info    fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *openDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *openDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *openDir) Close() error {
+	return nil
+}
+
+func (d *openDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(n, len(rest))]
+	d.offset += len(rest)
+	return rest, nil
+}
@@ -0,0 +1,52 @@
+// © 2022 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the ISC
+// license that can be found in the LICENSE file.
+
+package memfs
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFS(t *testing.T) {
+	var m FS
+	if err := fstest.TestFS(&m); err != nil {
+		t.Fatalf("empty FS: %v", err)
+	}
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"index.html":         "<p>Hello</p>",
+		"blog/index.html":    "<p>Blog</p>",
+		"blog/post.html":     "<p>Post</p>",
+		"css/main.css":       "body{}",
+		"css/vendor/a/b.css": "a{}",
+	}
+	for name, data := range files {
+		if err := m.WriteFile(name, []byte(data), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fstest.TestFS(&m, "index.html", "blog/post.html", "css/vendor/a/b.css"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.WriteFile("index.html", []byte("replaced"), now); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile(&m, "index.html"); err != nil || string(got) != "replaced" {
+		t.Fatalf("ReadFile(index.html) = %q, %v; want %q", got, err, "replaced")
+	}
+	if _, err := m.Open("missing.html"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Open(missing.html): want fs.ErrNotExist, got %v", err)
+	}
+	for _, name := range []string{"", ".", "/abs", "a/../b"} {
+		if err := m.WriteFile(name, nil, now); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("WriteFile(%q): want fs.ErrInvalid, got %v", name, err)
+		}
+	}
+}
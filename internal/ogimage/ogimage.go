@@ -0,0 +1,127 @@
+// © 2022 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the ISC
+// license that can be found in the LICENSE file.
+
+// Package ogimage generates Open Graph images ("social cards") with a page
+// title drawn on a background.
+package ogimage
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Size of generated images, as recommended by Open Graph consumers.
+const (
+	Width  = 1200
+	Height = 630
+)
+
+const (
+	margin   = 80
+	fontSize = 64
+)
+
+var (
+	defaultBackground = color.RGBA{0x12, 0x16, 0x1a, 0xff}
+	foreground        = color.White
+)
+
+// Options customize generated images.
+type Options struct {
+	// Font is a TrueType or OpenType font used to draw the title. Go Bold is
+	// used by default.
+	Font []byte
+	// Background is an image that is scaled to fill the card. A solid dark
+	// color is used by default.
+	Background image.Image
+}
+
+// Generate draws title on a card and returns it encoded as PNG.
+func Generate(title string, opts *Options) ([]byte, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+
+	fontData := opts.Font
+	if fontData == nil {
+		fontData = gobold.TTF
+	}
+	f, err := opentype.Parse(fontData)
+	if err != nil {
+		return nil, err
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    fontSize,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, Width, Height))
+	if opts.Background != nil {
+		xdraw.CatmullRom.Scale(img, img.Bounds(), opts.Background, opts.Background.Bounds(), draw.Src, nil)
+	} else {
+		draw.Draw(img, img.Bounds(), image.NewUniform(defaultBackground), image.Point{}, draw.Src)
+	}
+
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(foreground),
+		Face: face,
+	}
+	lineHeight := face.Metrics().Height.Ceil()
+	y := margin + face.Metrics().Ascent.Ceil()
+	for _, line := range wrap(d, title, Width-2*margin) {
+		if y > Height-margin {
+			break
+		}
+		d.Dot = fixed.P(margin, y)
+		d.DrawString(line)
+		y += lineHeight
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// wrap splits s into lines that fit into width pixels when drawn by d. Words
+// longer than width are put on their own line.
+func wrap(d *font.Drawer, s string, width int) []string {
+	var (
+		lines []string
+		line  string
+	)
+	for _, word := range strings.Fields(s) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && d.MeasureString(candidate).Ceil() > width {
+			lines = append(lines, line)
+			line = word
+			continue
+		}
+		line = candidate
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
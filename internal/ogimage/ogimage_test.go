@@ -0,0 +1,45 @@
+// © 2022 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the ISC
+// license that can be found in the LICENSE file.
+
+package ogimage
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	bg := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	draw.Draw(bg, bg.Bounds(), image.NewUniform(color.RGBA{0xff, 0, 0, 0xff}), image.Point{}, draw.Src)
+
+	cases := map[string]*Options{
+		"default":    nil,
+		"background": {Background: bg},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			b, err := Generate("A very long title of a post that should be wrapped into several lines", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := img.Bounds().Size(); got != (image.Point{Width, Height}) {
+				t.Fatalf("want size %dx%d, got %dx%d", Width, Height, got.X, got.Y)
+			}
+			if opts != nil {
+				// Corners are never covered by text.
+				if r, g, b, _ := img.At(0, 0).RGBA(); r != 0xffff || g != 0 || b != 0 {
+					t.Errorf("background wasn't drawn: got %v", img.At(0, 0))
+				}
+			}
+		})
+	}
+}
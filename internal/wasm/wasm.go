@@ -0,0 +1,76 @@
+// © 2022 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the ISC
+// license that can be found in the LICENSE file.
+
+// Package wasm builds Go programs as WebAssembly modules.
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Build compiles the main package in directory dir into a WebAssembly module
+// written to out. The package is built from within dir, so it doesn't matter
+// what the current directory is.
+//
+// It also copies wasm_exec.js from the Go distribution that compiled the
+// module to execJS, so the loader script can't drift from the toolchain. If
+// execJS is empty, the copy is skipped.
+func Build(dir, out, execJS string) error {
+	out, err := filepath.Abs(out)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+		return err
+	}
+
+	var errbuf bytes.Buffer
+	build := exec.Command("go", "build", "-o", out, ".")
+	build.Dir = dir
+	build.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	build.Stderr = &errbuf
+	if err := build.Run(); err != nil {
+		return fmt.Errorf("go build failed for %s: %v (it returned %q)", dir, err, errbuf.String())
+	}
+
+	if execJS == "" {
+		return nil
+	}
+	return copyExecJS(execJS)
+}
+
+func copyExecJS(dst string) error {
+	goroot, err := exec.Command("go", "env", "GOROOT").Output()
+	if err != nil {
+		return err
+	}
+	root := strings.TrimSpace(string(goroot))
+
+	// Go 1.24 moved wasm_exec.js from misc/wasm to lib/wasm.
+	var b []byte
+	for _, dir := range []string{"lib", "misc"} {
+		b, err = os.ReadFile(filepath.Join(root, dir, "wasm", "wasm_exec.js"))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("wasm_exec.js not found in %s: %w", root, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, b, 0o644)
+}
@@ -0,0 +1,48 @@
+// © 2022 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the ISC
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		out    = filepath.Join(dir, "wasm", "hello.wasm")
+		execJS = filepath.Join(dir, "js", "wasm_exec.js")
+	)
+
+	if err := Build("./testdata/hello", out, execJS); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// WebAssembly binary modules start with "\0asm".
+	if !bytes.HasPrefix(b, []byte("\x00asm")) {
+		t.Fatalf("%s doesn't look like a WebAssembly module", out)
+	}
+
+	js, err := os.ReadFile(execJS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(js, []byte("globalThis.Go")) {
+		t.Fatalf("%s doesn't look like wasm_exec.js", execJS)
+	}
+}
+
+func TestBuildFails(t *testing.T) {
+	dir := t.TempDir()
+	if err := Build("./testdata/does-not-exist", filepath.Join(dir, "out.wasm"), ""); err == nil {
+		t.Fatal("Build must fail for nonexistent package")
+	}
+}
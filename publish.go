@@ -0,0 +1,38 @@
+//usr/bin/env go run $0 $@; exit $?
+
+// © 2022 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the ISC
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.astrophena.name/site"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: ./publish.go [page]\n")
+		fmt.Fprintf(os.Stderr, "Marks a draft page as published and sets its date to today.\n")
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := site.Publish(flag.Arg(0), time.Now()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -23,14 +23,35 @@ import (
 func main() {
 	log.SetFlags(0)
 
-	listenFlag := flag.String("listen", "localhost:3000", "Listen on `host:port`.")
+	var (
+		chdirFlag         = flag.String("C", "", "Change to `dir` before running, instead of requiring to run from repo root.")
+		listenFlag        = flag.String("listen", "localhost:3000", "Listen on `host:port`.")
+		basePathStripFlag = flag.String("base-path-strip", "", "Strip `prefix` from request paths, to test deployments under a subpath.")
+		serveDirFlag      = flag.String("serve-dir", "", "Serve `dir` instead of the build directory.")
+		incrementalFlag   = flag.Bool("incremental-serve", false, "Build the site in memory and serve it from there instead of the build directory.")
+		failFastFlag      = flag.Bool("fail-fast", false, "Fail the whole build on a page error instead of replacing the page with an error page.")
+		accessLogFlag     = flag.String("access-log", "", "Append access log in Combined Log Format to `file`.")
+		concurrencyFlag   = flag.Int("j", 0, "Run at most `n` build jobs in parallel (0 means the number of CPUs).")
+		strictFlag        = flag.Bool("strict-front-matter", false, "Fail on unknown front matter fields.")
+		tlsFlag           = flag.Bool("tls", false, "Serve over HTTPS, with a self-signed certificate unless -tls-cert and -tls-key are set.")
+		tlsCertFlag       = flag.String("tls-cert", "", "Use PEM-encoded certificate from `file` for HTTPS.")
+		tlsKeyFlag        = flag.String("tls-key", "", "Use PEM-encoded private key from `file` for HTTPS.")
+		debounceFlag      = flag.Duration("debounce", 0, "Wait `duration` for file changes to settle before rebuilding (0 means the Serve default).")
+	)
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: ./serve.go [flags] [dir]\n")
 		fmt.Fprintf(os.Stderr, "Available flags:\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "SITE_SRC, SITE_DST and SITE_BASE_URL environment variables override defaults, flags override them.\n")
 	}
 	flag.Parse()
 
+	if *chdirFlag != "" {
+		if err := os.Chdir(*chdirFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	wd, err := os.Getwd()
 	if err != nil {
 		log.Fatal(err)
@@ -41,20 +62,45 @@ func main() {
 		log.Fatal(err)
 	}
 
-	dir := filepath.Join(".", "build")
+	// Flags take precedence over environment variables.
+	c := &site.Config{
+		BasePathStrip:     *basePathStripFlag,
+		ServeDir:          *serveDirFlag,
+		ServeFromMemory:   *incrementalFlag,
+		Concurrency:       *concurrencyFlag,
+		StrictFrontMatter: *strictFlag,
+		ContinueOnError:   !*failFastFlag,
+		ServeTLS:          *tlsFlag,
+		TLSCertFile:       *tlsCertFlag,
+		TLSKeyFile:        *tlsKeyFlag,
+		ServeDebounce:     *debounceFlag,
+	}
+	if err := c.ApplyEnv(os.Getenv); err != nil {
+		log.Fatal(err)
+	}
 	if len(flag.Args()) > 0 {
-		dir = flag.Args()[0]
+		c.Dst = flag.Args()[0]
 	}
 
-	c := &site.Config{
-		Src: ".",
-		Dst: dir,
+	var accessLog *os.File
+	if *accessLogFlag != "" {
+		accessLog, err = os.OpenFile(*accessLogFlag, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.AccessLog = accessLog
 	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	if err := site.Serve(ctx, c, *listenFlag); err != nil {
+	err = site.Serve(ctx, c, *listenFlag)
+	if accessLog != nil {
+		if err := accessLog.Close(); err != nil {
+			log.Print(err)
+		}
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -41,14 +41,29 @@ package site
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"html/template"
+	"image"
+	_ "image/jpeg" // for Open Graph image backgrounds
+	_ "image/png"  // for Open Graph image backgrounds
 	"io"
 	"io/fs"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/url"
@@ -56,15 +71,29 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	ttemplate "text/template"
+	"text/template/parse"
 	"time"
+	"unicode"
 
 	"go.astrophena.name/base/logger"
+	"go.astrophena.name/site/internal/memfs"
+	"go.astrophena.name/site/internal/ogimage"
 
+	"github.com/andybalholm/brotli"
 	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/feeds"
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/js"
+	"golang.org/x/sync/errgroup"
 	"rsc.io/markdown"
 )
 
@@ -76,6 +105,32 @@ var (
 	errFrontmatterMissingParam = errors.New("missing required frontmatter parameter (title, template, permalink)")
 	errFormatUnsupported       = errors.New("format unsupported")
 	errPermalinkInvalid        = errors.New("invalid permalink")
+	errOutputInvalid           = errors.New("invalid output path")
+	errNotDraft                = errors.New("page is not a draft")
+)
+
+// BuildError is an error that occurred while building a page.
+type BuildError struct {
+	// Path is the path to the page source.
+	Path string
+	// Phase is the build phase that failed.
+	Phase Phase
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *BuildError) Error() string { return e.Path + ": " + e.Err.Error() }
+
+func (e *BuildError) Unwrap() error { return e.Err }
+
+// Phase is a phase of building a page.
+type Phase string
+
+// Possible build phases.
+const (
+	PhaseParse  Phase = "parse"  // parsing front matter
+	PhaseRender Phase = "render" // executing templates and rendering Markdown
+	PhaseWrite  Phase = "write"  // writing the page to disk
 )
 
 // Config represents a build configuration.
@@ -92,24 +147,334 @@ type Config struct {
 	// Dst is the directory where to write files. If empty, uses the build
 	// directory.
 	Dst string
+	// DraftsDst is the directory where drafts are written in production mode,
+	// using the same templates as other pages. Drafts aren't linked from
+	// anywhere on the site and don't appear in the feed. If empty, drafts are
+	// excluded from production builds entirely.
+	DraftsDst string
 	// Logf specifies a logger to use. If nil, log.Printf is used.
 	Logf logger.Logf
 	// Prod determines if the site should be built in a production mode. This
 	// means that drafts are excluded and the base URL is used to derive absolute
 	// URLs from relative ones.
 	Prod bool
+	// AbsolutizeLinks determines if root-relative links in href and src
+	// attributes of rendered pages (e.g. Markdown links) should be rewritten to
+	// absolute ones derived from the base URL. Used only in production mode.
+	AbsolutizeLinks bool
+	// PrefixHeadingIDs determines if IDs of headings in page contents should be
+	// prefixed to avoid collisions when content of several pages is combined.
+	// The prefix is the heading_id_prefix front matter field or, if it's
+	// empty, the last element of permalink. In-page links to headings are
+	// rewritten accordingly.
+	PrefixHeadingIDs bool
+	// Preload determines if preloadLinks template function should emit
+	// preload hints for CSS and JavaScript files of all pages. Can be enabled
+	// for a single page with the preload front matter field.
+	Preload bool
 	// SkipFeed determines if the feed for site shouldn't be built.
 	SkipFeed bool
+	// SkipFinalNewline disables ensuring that each built page and feed ends
+	// with a single newline.
+	SkipFinalNewline bool
+	// FeedSelfURL is an absolute URL from which the site-wide feed is served.
+	// If set, it's used as the feed ID and its rel="self" link instead of the
+	// URL derived from BaseURL.
+	FeedSelfURL string
+	// CategoryFeeds maps a page type to the path of its listing page, e.g.
+	// {"post": "/blog"}. Each type gets its own feed in addition to the
+	// site-wide one, written to /blog/feed.xml and advertised on the /blog
+	// page.
+	CategoryFeeds map[string]string
+	// TagFeeds maps a tag to the path of its listing page, like CategoryFeeds
+	// does for page types. The feed contains posts with the tag.
+	TagFeeds map[string]string
 	// Vanity determines if the site is vanity import domain built with vanity
 	// package. If so, navigation links created with navLink will point to URLs
 	// derived from PrimaryURL instead of BaseURL.
 	Vanity bool
 	// PrimaryURL is the base URL for navigation links when Vanity set to true.
 	PrimaryURL *url.URL
+	// BasePathStrip is a path prefix that Serve strips from request paths
+	// before resolving them against Dst, to test deployments under a
+	// subpath. Requests outside of the prefix get 404.
+	BasePathStrip string
+	// ServeDir is a directory that Serve serves instead of Dst, while still
+	// building into Dst, optional.
+	ServeDir string
+	// AccessLog is where Serve writes an access log in Combined Log Format,
+	// optional.
+	AccessLog io.Writer
+	// ServeFromMemory makes Serve build the site in memory and serve it from
+	// there instead of Dst, atomically replacing the served files after each
+	// rebuild.
+	ServeFromMemory bool
+	// ServeTLS makes Serve listen over HTTPS, to test features that require a
+	// secure context, like service workers. If TLSCertFile and TLSKeyFile are
+	// not set, a self-signed certificate for localhost is generated.
+	ServeTLS bool
+	// ServeDebounce is how long Serve waits for file changes to settle before
+	// rebuilding, so bursts of changes from editors cause a single rebuild.
+	// 0 means 250ms.
+	ServeDebounce time.Duration
+	// TLSCertFile and TLSKeyFile are paths to a PEM-encoded certificate and
+	// its key used by Serve, optional. Setting them requires ServeTLS.
+	TLSCertFile, TLSKeyFile string
+	// WebmentionEndpoint is a URL of the Webmention endpoint advertised by
+	// pages, optional.
+	WebmentionEndpoint string
+	// MicropubEndpoint is a URL of the Micropub endpoint advertised by pages,
+	// optional.
+	MicropubEndpoint string
+	// MinPageSize is a size in bytes below which a rendered page is considered
+	// suspiciously small and a warning is logged. Empty pages are always
+	// warned about.
+	MinPageSize int
+	// CheckHead enables checking that each built page declares a charset and
+	// a viewport in meta tags. It can be "warn" to log a warning or "strict"
+	// to fail the build. Disabled by default.
+	CheckHead string
+	// CheckNavLinks enables checking that navigation links made by navLink
+	// point to pages that exist in the current build, e.g. aren't drafts
+	// excluded from production. It can be "warn" to log a warning, "skip" to
+	// also omit such links or "strict" to fail the build. Disabled by default.
+	CheckNavLinks string
+	// AllowDateTime allows page dates with time in RFC 3339 format, e.g.
+	// 2006-01-02T15:04:05Z07:00, for scheduled posts.
+	AllowDateTime bool
+	// TagTemplate is a name of the template used to build tag pages at
+	// /tags/<slug>, listing posts with the tag. Tag pages are built only if
+	// the template exists. "tag" by default.
+	TagTemplate string
+	// WordsPerMinute is a reading speed used to estimate reading time of
+	// pages. 0 means 200.
+	WordsPerMinute int
+	// LazyImages adds loading="lazy" and decoding="async" attributes to images
+	// in page contents that don't have them. Images with "eager" title are
+	// left alone.
+	LazyImages bool
+	// Bundles maps a bundle name, e.g. "main.css", to a list of files in the
+	// static directory that are concatenated in order into a single file.
+	// CSS and JavaScript bundles are minified. Bundles are written to Dst under a content-addressed name, like
+	// "main.0123456789abcdef.css", and referenced in templates with the bundle
+	// function, e.g. {{ bundle "main.css" }}.
+	Bundles map[string][]string
+	// Precompress makes production builds write gzip and Brotli compressed
+	// copies of compressible files next to them, with .gz and .br extensions,
+	// for servers that don't compress on the fly.
+	Precompress bool
+	// CompressibleTypes are media types of files compressed when Precompress
+	// is set, like "image/svg+xml". "text/*" matches all text types. Media
+	// types are determined by file extensions from a fixed table. By default,
+	// text, JavaScript, JSON, XML and SVG files are compressed.
+	CompressibleTypes []string
+	// InferFrontmatter allows Markdown pages without front matter: title is
+	// taken from the leading "# Heading", permalink from the page path
+	// relative to the pages directory, and template is DefaultTemplate.
+	InferFrontmatter bool
+	// DefaultTemplate is a template used for pages with inferred front
+	// matter, "main" by default.
+	DefaultTemplate string
+	// SearchIndex makes the build write search-index.json with titles,
+	// permalinks, summaries and plain text contents of pages, for client-side
+	// search. Drafts and pages with "index": false in front matter are
+	// excluded.
+	SearchIndex bool
+	// VerifyOutput makes the build re-read its output and check that every
+	// HTML file has balanced tags and every root-relative link, including ones
+	// to bundles and generated images, resolves to a built file. All problems
+	// are returned as a single error.
+	VerifyOutput bool
+	// Markdown disables Markdown extensions used to render pages. All
+	// extensions are enabled by default.
+	Markdown MarkdownOptions
+	// Emoji maps custom shortcodes without colons, e.g. "party-parrot", to
+	// text or, if starting with "/" or "http", to an image URL, expanded in
+	// page contents outside code. Shortcodes known to the Markdown parser,
+	// like :rocket:, are expanded in Markdown pages anyway when the Emoji
+	// extension is enabled. Unknown shortcodes are left as is.
+	Emoji map[string]string
+	// ContinueOnError makes a page that fails to render replaced with an
+	// error page, instead of failing the whole build. Errors are logged as
+	// warnings. Useful for development.
+	ContinueOnError bool
+	// StrictFrontMatter makes unknown front matter fields an error instead of
+	// silently ignoring them, to catch typos.
+	StrictFrontMatter bool
+	// RedirectRules are pattern redirects written to the _redirects file and
+	// honored by Serve, optional.
+	RedirectRules []RedirectRule
+	// Features are feature flags that templates can check with the feature
+	// function, e.g. to enable experimental sections per environment. Unknown
+	// features are disabled.
+	Features map[string]bool
+	// Deploy indicates that the build is going to be deployed. A warning is
+	// logged if Prod is not set.
+	Deploy bool
+	// Concurrency limits how many goroutines are used by parallel build
+	// phases. Zero means runtime.NumCPU().
+	Concurrency int
+	// GenerateOGImages enables generating Open Graph images with a page title
+	// for pages that don't set the image front matter field.
+	GenerateOGImages bool
+	// OGImageFont is a path to a TrueType or OpenType font used to draw titles
+	// on generated Open Graph images, optional.
+	OGImageFont string
+	// OGImageBackground is a path to a PNG or JPEG image used as a background
+	// of generated Open Graph images, optional.
+	OGImageBackground string
 
 	feedCreated time.Time // used in tests
 }
 
+// MarkdownOptions disable Markdown extensions, see the fields of
+// markdown.Parser with the same names without the Disable prefix for details.
+// All extensions are enabled by default, so the zero value enables all of
+// them and a caller only sets fields for the extensions to turn off.
+type MarkdownOptions struct {
+	DisableHeadingID          bool // {#id} heading IDs
+	DisableStrikethrough      bool // ~~text~~
+	DisableTaskList           bool // - [x] task lists
+	DisableAutoLinkText       bool // bare URLs become links
+	DisableAutoLinkAssumeHTTP bool // bare www.example.com becomes a link
+	DisableTable              bool // GitHub tables
+	DisableEmoji              bool // :emoji: shortcodes
+	DisableSmartDot           bool // ... becomes an ellipsis
+	DisableSmartDash          bool // -- and --- become dashes
+	DisableSmartQuote         bool // "quotes" become typographic quotes
+	DisableFootnote           bool // [^1] footnotes
+}
+
+// RedirectRule is a pattern redirect. Rules are written to the _redirects file
+// in Netlify format and honored by Serve for paths that have no file.
+type RedirectRule struct {
+	// From is a path to redirect from. Its last segment can be a * splat that
+	// matches the rest of the path, and any segment can be a :placeholder that
+	// matches a single segment.
+	From string
+	// To is a path or URL to redirect to. It can reference the splat with
+	// :splat and placeholders by name.
+	To string
+	// Status is an HTTP status code of the redirect, 301 by default.
+	Status int
+}
+
+var redirectPlaceholderRe = regexp.MustCompile(`:[A-Za-z_][A-Za-z0-9_]*`)
+
+func (r RedirectRule) status() int {
+	if r.Status == 0 {
+		return http.StatusMovedPermanently
+	}
+	return r.Status
+}
+
+func (r RedirectRule) validate() error {
+	if !strings.HasPrefix(r.From, "/") {
+		return fmt.Errorf("redirect rule %q: from must start with /", r.From)
+	}
+	if r.To == "" {
+		return fmt.Errorf("redirect rule %q: to is empty", r.From)
+	}
+	if strings.ContainsAny(r.From+r.To, " \t\n") {
+		return fmt.Errorf("redirect rule %q: paths can't contain whitespace", r.From)
+	}
+	segs := strings.Split(r.From, "/")
+	for i, seg := range segs {
+		switch {
+		case seg == "*" && i != len(segs)-1:
+			return fmt.Errorf("redirect rule %q: splat must be the last segment", r.From)
+		case strings.Contains(seg, "*") && seg != "*":
+			return fmt.Errorf("redirect rule %q: splat must be a whole segment", r.From)
+		case strings.HasPrefix(seg, ":") && !redirectPlaceholderRe.MatchString(seg):
+			return fmt.Errorf("redirect rule %q: invalid placeholder %q", r.From, seg)
+		}
+	}
+	if s := r.status(); s < 300 || s > 399 {
+		return fmt.Errorf("redirect rule %q: invalid status %d", r.From, s)
+	}
+	return nil
+}
+
+// match reports whether p matches the rule and returns the target with
+// placeholders substituted.
+func (r RedirectRule) match(p string) (string, bool) {
+	var (
+		from   = strings.Split(r.From, "/")
+		segs   = strings.Split(p, "/")
+		values = make(map[string]string)
+	)
+	for i, seg := range from {
+		if seg == "*" {
+			values["splat"] = strings.Join(segs[min(i, len(segs)):], "/")
+			return r.expand(values), true
+		}
+		if i >= len(segs) {
+			return "", false
+		}
+		if strings.HasPrefix(seg, ":") {
+			values[seg[1:]] = segs[i]
+			continue
+		}
+		if seg != segs[i] {
+			return "", false
+		}
+	}
+	if len(segs) != len(from) {
+		return "", false
+	}
+	return r.expand(values), true
+}
+
+func (r RedirectRule) expand(values map[string]string) string {
+	return redirectPlaceholderRe.ReplaceAllStringFunc(r.To, func(s string) string {
+		if v, ok := values[s[1:]]; ok {
+			return v
+		}
+		return s
+	})
+}
+
+// writeRedirects writes redirect rules to the _redirects file.
+func (b *buildContext) writeRedirects() error {
+	var sb strings.Builder
+	for _, r := range b.c.RedirectRules {
+		fmt.Fprintf(&sb, "%s %s %d\n", r.From, r.To, r.status())
+	}
+	return b.writeFile(b.c.Dst, "_redirects", []byte(sb.String()))
+}
+
+// Environment variables read by [Config.ApplyEnv].
+const (
+	envSrc     = "SITE_SRC"
+	envDst     = "SITE_DST"
+	envBaseURL = "SITE_BASE_URL"
+)
+
+// ApplyEnv sets Src, Dst and BaseURL from the SITE_SRC, SITE_DST and
+// SITE_BASE_URL environment variables, looked up with getenv, if they are set.
+//
+// Tools call it before applying command-line flags, so flags take precedence
+// over environment variables, which take precedence over defaults.
+func (c *Config) ApplyEnv(getenv func(string) string) error {
+	if src := getenv(envSrc); src != "" {
+		c.Src = src
+	}
+	if dst := getenv(envDst); dst != "" {
+		c.Dst = dst
+	}
+	if base := getenv(envBaseURL); base != "" {
+		u, err := url.Parse(base)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", envBaseURL, err)
+		}
+		if !u.IsAbs() {
+			return fmt.Errorf("invalid %s %q: must be absolute", envBaseURL, base)
+		}
+		c.BaseURL = u
+	}
+	return nil
+}
+
 func (c *Config) setDefaults() {
 	if c == nil {
 		c = &Config{}
@@ -147,81 +512,1113 @@ func (c *Config) setDefaults() {
 	if c.Dst == "" {
 		c.Dst = filepath.Join(".", "build")
 	}
+
+	if c.TagTemplate == "" {
+		c.TagTemplate = "tag"
+	}
+	if c.DefaultTemplate == "" {
+		c.DefaultTemplate = "main"
+	}
+}
+
+func (c *Config) validate() error {
+	if c.FeedSelfURL != "" {
+		u, err := url.Parse(c.FeedSelfURL)
+		if err != nil {
+			return fmt.Errorf("invalid FeedSelfURL: %w", err)
+		}
+		if !u.IsAbs() {
+			return fmt.Errorf("invalid FeedSelfURL %q: must be absolute", c.FeedSelfURL)
+		}
+	}
+	if c.ServeDir != "" && c.ServeFromMemory {
+		return errors.New("ServeDir and ServeFromMemory are mutually exclusive")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("TLSCertFile and TLSKeyFile must be set together")
+	}
+	if c.TLSCertFile != "" && !c.ServeTLS {
+		return errors.New("TLSCertFile and TLSKeyFile require ServeTLS")
+	}
+	for name, srcs := range c.Bundles {
+		if name == "" || path.Ext(name) == "" {
+			return fmt.Errorf("invalid bundle name %q: must have an extension", name)
+		}
+		if len(srcs) == 0 {
+			return fmt.Errorf("bundle %q has no files", name)
+		}
+	}
+	listings := make(map[string]bool)
+	for _, m := range []map[string]string{c.CategoryFeeds, c.TagFeeds} {
+		for name, listing := range m {
+			if !strings.HasPrefix(listing, "/") || listing == "/" {
+				return fmt.Errorf("invalid listing path %q of feed %q: must start with / and not be the root", listing, name)
+			}
+			if listings[listing] {
+				return fmt.Errorf("listing path %q is used by more than one feed", listing)
+			}
+			listings[listing] = true
+		}
+	}
+	for _, r := range c.RedirectRules {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	switch c.CheckHead {
+	case "", "warn", "strict":
+	default:
+		return fmt.Errorf("invalid CheckHead %q: must be \"warn\" or \"strict\"", c.CheckHead)
+	}
+	switch c.CheckNavLinks {
+	case "", "warn", "skip", "strict":
+	default:
+		return fmt.Errorf("invalid CheckNavLinks %q: must be \"warn\", \"skip\" or \"strict\"", c.CheckNavLinks)
+	}
+	return nil
 }
 
 // Build builds a site based on the provided [Config].
 func Build(c *Config) error {
+	_, _, err := build(c, false, nil)
+	return err
+}
+
+// BuildToFS builds a site based on the provided [Config] in memory and returns
+// the result as a file system, without writing to Dst. Drafts are still
+// written to DraftsDst, if it's set.
+func BuildToFS(c *Config) (fs.FS, error) {
+	_, fsys, err := build(c, true, nil)
+	return fsys, err
+}
+
+// BuildResult builds a site like [Build] and returns a description of built
+// pages, e.g. for post-build steps.
+func BuildResult(c *Config) (*Result, error) {
+	res, _, err := build(c, false, nil)
+	return res, err
+}
+
+// Result describes a finished build, returned by [BuildResult].
+type Result struct {
+	Pages []*BuiltPage `json:"pages"` // pages written to Dst, sorted by date like in Build
+}
+
+// BuiltPage describes a single page in a [Result].
+type BuiltPage struct {
+	Title     string     `json:"title"`
+	Permalink string     `json:"permalink"`
+	Path      string     `json:"path"` // slash-separated path of the built page relative to Dst
+	Type      string     `json:"type,omitempty"`
+	Date      *time.Time `json:"date,omitempty"`
+}
+
+// result returns a description of pages written to Dst, except ones that
+// failed to build.
+func (b *buildContext) result() *Result {
+	res := &Result{Pages: []*BuiltPage{}}
+	for _, p := range slices.Concat(b.pages, b.tagPages, b.paginated) {
+		if p.failed || p.RedirectTo != "" {
+			continue
+		}
+		bp := &BuiltPage{
+			Title:     p.Title,
+			Permalink: p.Permalink,
+			Path:      strings.TrimPrefix(p.dstPath, "/"),
+			Type:      p.Type,
+		}
+		if p.Date != nil && !p.Date.IsZero() {
+			bp.Date = &p.Date.Time
+		}
+		res.Pages = append(res.Pages, bp)
+	}
+	return res
+}
+
+// outputState is kept by Serve across rebuilds, so the next build can skip
+// rendering pages and writing files that didn't change.
+type outputState struct {
+	hashes   map[string][sha256.Size]byte // by slash-separated path relative to Dst
+	renders  map[string]*renderedPage     // by page source path, see reuseRender
+	rendered []string                     // sources of pages rendered by the last build rather than reused
+}
+
+// renderedPage is the result of rendering a page, see outputState.
+type renderedPage struct {
+	sum        [sha256.Size]byte // of the page source
+	headingIDs bool              // whether headings got IDs, see autoHeadingIDs
+	html       []byte
+	excerpt    []byte
+	summary    string
+}
+
+// build builds a site. If state is not nil, the build is incremental: pages
+// whose source didn't change since the previous build recorded in state are
+// not rendered again, files in Dst that have the same contents are left
+// alone, and files that weren't written again are removed.
+func build(c *Config, inMemory bool, state *outputState) (*Result, fs.FS, error) {
 	c.setDefaults()
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
 	b := newBuildContext(c)
+	if c.Deploy && !c.Prod {
+		b.warnf("building for deploy, but not in production mode")
+	}
+	if inMemory {
+		b.mem = new(memfs.FS)
+	}
+	if state != nil {
+		b.state = state
+		b.prev = state.hashes
+		b.written = make(map[string][sha256.Size]byte)
+		b.renders = make(map[string]*renderedPage)
+		// A build failing partway may have rewritten some files already, so
+		// forget the previous build until this one succeeds, making the next
+		// build a full one.
+		state.hashes = nil
+	}
 
 	// Parse templates and pages.
 	if err := filepath.WalkDir(filepath.Join(b.c.Src, "templates"), b.parseTemplates); err != nil {
-		return err
+		return nil, nil, err
 	}
-	if err := filepath.WalkDir(filepath.Join(b.c.Src, "pages"), b.parsePages); err != nil {
-		return err
+	if err := b.parseAllPages(); err != nil {
+		return nil, nil, err
 	}
-
-	// Sort pages by date. Pages without date are pushed to the end.
-	sort.SliceStable(b.pages, func(i, j int) bool {
-		if b.pages[i].Date == nil || b.pages[j].Date == nil {
-			return true
+	if _, ok := b.templates[b.c.TagTemplate]; ok {
+		if err := b.addTagPages(); err != nil {
+			return nil, nil, err
 		}
-		return !b.pages[i].Date.Time.Before(b.pages[j].Date.Time)
-	})
+	}
 
 	// Clean up after previous build.
-	if _, err := os.Stat(b.c.Dst); err == nil {
-		if err := os.RemoveAll(b.c.Dst); err != nil {
+	var dirs []string
+	if b.mem == nil && b.prev == nil {
+		dirs = append(dirs, b.c.Dst)
+	}
+	if len(b.drafts) > 0 {
+		dirs = append(dirs, b.c.DraftsDst)
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err == nil {
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if b.c.GenerateOGImages {
+		if err := b.generateOGImages(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(b.c.Bundles) > 0 {
+		if err := b.writeBundles(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Render all pages before executing layouts, so they can use summaries
+	// extracted from other pages.
+	for _, p := range b.pages {
+		if b.reuseRender(p) {
+			continue
+		}
+		if err := p.render(b); err != nil {
+			if err := b.pageFailed(p, b.c.Dst, err); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// Build pages and RSS feed.
+	for _, p := range slices.Concat(b.pages, b.tagPages) {
+		if p.failed {
+			continue
+		}
+		if err := b.writePage(p, b.c.Dst); err != nil {
+			if err := b.pageFailed(p, b.c.Dst, err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if err := b.writePaginated(p); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, p := range b.drafts {
+		if err := b.writePage(p, b.c.DraftsDst); err != nil {
+			if err := b.pageFailed(p, b.c.DraftsDst, err); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if !b.c.SkipFeed {
+		if err := b.buildFeed(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if b.c.SearchIndex {
+		if err := b.writeSearchIndex(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(b.c.RedirectRules) > 0 {
+		if err := b.writeRedirects(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Copy static files.
+	static := os.DirFS(filepath.Join(b.c.Src, "static"))
+	var out fs.FS
+	if b.mem != nil {
+		out = b.mem
+	}
+	if b.mem == nil && b.written == nil {
+		if err := os.CopyFS(b.c.Dst, static); err != nil {
+			return nil, nil, err
+		}
+		out = os.DirFS(b.c.Dst)
+	} else if err := fs.WalkDir(static, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(static, name)
+		if err != nil {
 			return err
 		}
+		return b.writeFile(b.c.Dst, name, data)
+	}); err != nil {
+		return nil, nil, err
+	}
+	if b.written != nil {
+		if err := b.removeStale(); err != nil {
+			return nil, nil, err
+		}
+		state.hashes = b.written
+		state.renders, state.rendered = b.renders, b.renderedPaths
+		out = os.DirFS(b.c.Dst)
+	}
+
+	if b.c.Prod && b.c.Precompress {
+		if err := b.precompress(out); err != nil {
+			return nil, nil, err
+		}
+	}
+	if b.c.VerifyOutput {
+		if err := b.verifyOutput(out); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if b.c.Prod || b.c.Deploy {
+		b.c.Logf("%s", b.summary())
+	}
+	return b.result(), out, nil
+}
+
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/atom+xml",
+	"application/rss+xml",
+	"image/svg+xml",
+}
+
+// mediaTypes maps file extensions to media types for deciding what to
+// compress. Unlike mime.TypeByExtension, it doesn't depend on MIME tables of
+// the host, so builds produce the same output everywhere.
+var mediaTypes = map[string]string{
+	".atom":        "application/atom+xml",
+	".avif":        "image/avif",
+	".css":         "text/css",
+	".csv":         "text/csv",
+	".gif":         "image/gif",
+	".htm":         "text/html",
+	".html":        "text/html",
+	".ico":         "image/vnd.microsoft.icon",
+	".jpeg":        "image/jpeg",
+	".jpg":         "image/jpeg",
+	".js":          "application/javascript",
+	".json":        "application/json",
+	".map":         "application/json",
+	".md":          "text/markdown",
+	".mjs":         "application/javascript",
+	".pdf":         "application/pdf",
+	".png":         "image/png",
+	".rss":         "application/rss+xml",
+	".svg":         "image/svg+xml",
+	".ttf":         "font/ttf",
+	".txt":         "text/plain",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".xml":         "application/xml",
+}
+
+// compressible reports whether a file with name should be compressed, see
+// CompressibleTypes.
+func (b *buildContext) compressible(name string) bool {
+	typ, ok := mediaTypes[strings.ToLower(path.Ext(name))]
+	if !ok {
+		return false
+	}
+	types := b.c.CompressibleTypes
+	if types == nil {
+		types = defaultCompressibleTypes
+	}
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(typ, prefix+"/") {
+				return true
+			}
+		} else if typ == t {
+			return true
+		}
 	}
-	if err := os.MkdirAll(b.c.Dst, 0o755); err != nil {
+	return false
+}
+
+// precompress writes gzip and Brotli compressed copies of compressible files
+// in out, see Precompress.
+func (b *buildContext) precompress(out fs.FS) error {
+	var names []string
+	if err := fs.WalkDir(out, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if b.compressible(name) {
+			names = append(names, name)
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
 
-	// Build pages and RSS feed.
-	for _, p := range b.pages {
-		if err := os.MkdirAll(filepath.Dir(filepath.Join(b.c.Dst, p.dstPath)), 0o755); err != nil {
+	for _, name := range names {
+		data, err := fs.ReadFile(out, name)
+		if err != nil {
 			return err
 		}
 
-		f, err := os.Create(filepath.Join(b.c.Dst, p.dstPath))
+		var gz bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&gz, gzip.BestCompression)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if err := b.writeFile(b.c.Dst, name+".gz", gz.Bytes()); err != nil {
+			return err
+		}
+
+		var br bytes.Buffer
+		bw := brotli.NewWriterLevel(&br, brotli.BestCompression)
+		if _, err := bw.Write(data); err != nil {
+			return err
+		}
+		if err := bw.Close(); err != nil {
+			return err
+		}
+		if err := b.writeFile(b.c.Dst, name+".br", br.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		tpl, ok := b.templates[p.Template]
-		if !ok {
-			return fmt.Errorf("%s: no such template %q", p.path, p.Template)
+// verifyOutput checks the built site in out, see VerifyOutput.
+func (b *buildContext) verifyOutput(out fs.FS) error {
+	var errs []error
+	if err := fs.WalkDir(out, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(name) != ".html" {
+			return err
 		}
-		if err := p.build(b, tpl, f); err != nil {
+		doc, err := fs.ReadFile(out, name)
+		if err != nil {
 			return err
 		}
+		if err := checkTags(doc); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		for _, link := range b.internalLinks(doc) {
+			if !resolves(out, link) {
+				errs = append(errs, fmt.Errorf("%s: broken link %q", name, link))
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("verifying output: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+var linkRe = regexp.MustCompile(`\b(?:href|src)="([^"]*)"`)
+
+// internalLinks returns paths of root-relative links in doc, including links
+// made absolute with BaseURL.
+func (b *buildContext) internalLinks(doc []byte) []string {
+	base := strings.TrimSuffix(b.c.BaseURL.String(), "/")
+	var links []string
+	for _, m := range linkRe.FindAllSubmatch(doc, -1) {
+		link := html.UnescapeString(string(m[1]))
+		if rest, ok := strings.CutPrefix(link, base); ok && b.c.Prod && (rest == "" || strings.HasPrefix(rest, "/")) {
+			link = "/" + strings.TrimPrefix(rest, "/")
+		}
+		if !strings.HasPrefix(link, "/") || strings.HasPrefix(link, "//") {
+			continue
+		}
+		if i := strings.IndexAny(link, "?#"); i >= 0 {
+			link = link[:i]
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// resolves reports whether link resolves to a file in out, the same way
+// as in Serve.
+func resolves(out fs.FS, link string) bool {
+	p := strings.TrimPrefix(path.Clean(link), "/")
+	if p == "" {
+		p = "."
+	}
+	for _, name := range []string{p, p + ".html", path.Join(p, "index.html")} {
+		if d, err := fs.Stat(out, name); err == nil && !d.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	tagRe = regexp.MustCompile(`(?s)<!--.*?-->|<(/?)([a-zA-Z][a-zA-Z0-9-]*)\b(?:[^>"']|"[^"]*"|'[^']*')*?(/?)>`)
+
+	voidElements = map[string]bool{
+		"area": true, "base": true, "br": true, "col": true, "embed": true,
+		"hr": true, "img": true, "input": true, "link": true, "meta": true,
+		"source": true, "track": true, "wbr": true,
+	}
+	// Elements with end tags that can be omitted.
+	optionalEndTag = map[string]bool{
+		"html": true, "head": true, "body": true, "p": true, "li": true,
+		"dt": true, "dd": true, "option": true, "optgroup": true, "tr": true,
+		"td": true, "th": true, "thead": true, "tbody": true, "tfoot": true,
+		"colgroup": true, "rt": true, "rp": true,
+	}
+	// Elements with contents that are not parsed as HTML.
+	rawTextElements = map[string]bool{
+		"script": true, "style": true, "textarea": true, "title": true,
+	}
+)
+
+// checkTags checks that elements in doc are properly nested and closed,
+// allowing end tags that HTML makes optional.
+func checkTags(doc []byte) error {
+	var stack []string
+	for i := 0; i < len(doc); {
+		loc := tagRe.FindSubmatchIndex(doc[i:])
+		if loc == nil {
+			break
+		}
+		for j := range loc {
+			if loc[j] >= 0 {
+				loc[j] += i
+			}
+		}
+		start := loc[0]
+		i = loc[1]
+		if loc[4] < 0 { // comment
+			continue
+		}
+		closing := loc[3] > loc[2]
+		name := strings.ToLower(string(doc[loc[4]:loc[5]]))
+		selfClosing := loc[7] > loc[6]
+
+		if !closing {
+			if voidElements[name] || selfClosing {
+				continue
+			}
+			if rawTextElements[name] {
+				// Skip to the end tag.
+				j := bytes.Index(bytes.ToLower(doc[i:]), []byte("</"+name))
+				if j < 0 {
+					return fmt.Errorf("unclosed <%s> at offset %d", name, start)
+				}
+				i += j
+				stack = append(stack, name)
+				continue
+			}
+			stack = append(stack, name)
+			continue
+		}
+
+		// Pop elements with optional end tags until the matching one.
+		j := len(stack) - 1
+		for j >= 0 && stack[j] != name && optionalEndTag[stack[j]] {
+			j--
+		}
+		if j >= 0 && stack[j] != name {
+			return fmt.Errorf("unclosed <%s> before </%s> at offset %d", stack[j], name, start)
+		}
+		if j < 0 {
+			return fmt.Errorf("unexpected </%s> at offset %d", name, start)
+		}
+		stack = stack[:j]
+	}
+	for _, name := range stack {
+		if !optionalEndTag[name] {
+			return fmt.Errorf("unclosed <%s>", name)
+		}
+	}
+	return nil
+}
+
+// summary describes which production-only behavior was applied to the build,
+// to catch deploying a build made with the wrong configuration. It's logged
+// only for production and deploy builds.
+func (b *buildContext) summary() string {
+	mode, drafts, urls, links, feed := "development", "included", "root-relative", "root-relative", "skipped"
+	if b.c.Prod {
+		mode, drafts = "production", "excluded"
+		if b.c.DraftsDst != "" {
+			drafts = fmt.Sprintf("excluded, %d written to %s", len(b.drafts), b.c.DraftsDst)
+		}
+		if b.c.BaseURL != nil {
+			urls = "absolute"
+			if b.c.AbsolutizeLinks {
+				links = "absolute"
+			}
+		}
 	}
 	if !b.c.SkipFeed {
-		if err := b.buildFeed(); err != nil {
+		// Feed readers can't resolve relative links, so feeds always link to
+		// BaseURL regardless of mode.
+		feed = "built with absolute URLs"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Built %d pages in %s mode:\n", len(b.pages), mode)
+	fmt.Fprintf(&sb, "  drafts: %s\n", drafts)
+	fmt.Fprintf(&sb, "  feed: %s\n", feed)
+	fmt.Fprintf(&sb, "  url function: %s URLs\n", urls)
+	fmt.Fprintf(&sb, "  links in content: %s", links)
+	return sb.String()
+}
+
+// generateOGImages generates Open Graph images for pages that don't set one
+// and writes them to Dst under a content-addressed path.
+func (b *buildContext) generateOGImages() error {
+	opts := new(ogimage.Options)
+	if b.c.OGImageFont != "" {
+		font, err := os.ReadFile(b.c.OGImageFont)
+		if err != nil {
 			return err
 		}
+		opts.Font = font
+	}
+	if b.c.OGImageBackground != "" {
+		f, err := os.Open(b.c.OGImageBackground)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		bg, _, err := image.Decode(f)
+		if err != nil {
+			return fmt.Errorf("decoding %s: %w", b.c.OGImageBackground, err)
+		}
+		opts.Background = bg
 	}
 
-	// Copy static files.
-	if err := os.CopyFS(b.c.Dst, os.DirFS(filepath.Join(b.c.Src, "static"))); err != nil {
+	return b.forEach(slices.Concat(b.pages, b.tagPages), func(p *Page) error {
+		if p.Image != "" || p.RedirectTo != "" {
+			return nil
+		}
+		card, err := ogimage.Generate(p.Title, opts)
+		if err != nil {
+			return &BuildError{Path: p.path, Phase: PhaseRender, Err: err}
+		}
+		sum := sha256.Sum256(card)
+		p.ogImage = "/og/" + hex.EncodeToString(sum[:8]) + ".png"
+		if err := b.writeFile(b.c.Dst, p.ogImage, card); err != nil {
+			return &BuildError{Path: p.path, Phase: PhaseWrite, Err: err}
+		}
+		return nil
+	})
+}
+
+// bundleMinifier minifies CSS and JavaScript bundles. Bundles of other types
+// are written as is.
+var bundleMinifier = func() *minify.M {
+	m := minify.New()
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("application/javascript", js.Minify)
+	return m
+}()
+
+// writeBundles concatenates files of each bundle, minifies the result and
+// writes it to Dst under a name derived from the hash of the minified bytes.
+func (b *buildContext) writeBundles() error {
+	static := os.DirFS(filepath.Join(b.c.Src, "static"))
+	b.bundles = make(map[string]string)
+	for name, srcs := range b.c.Bundles {
+		var buf bytes.Buffer
+		for _, src := range srcs {
+			data, err := fs.ReadFile(static, strings.TrimPrefix(src, "/"))
+			if err != nil {
+				return fmt.Errorf("bundle %q: %w", name, err)
+			}
+			buf.Write(data)
+			if len(data) > 0 && data[len(data)-1] != '\n' {
+				buf.WriteByte('\n')
+			}
+		}
+		ext := path.Ext(name)
+		data, err := bundleMinifier.Bytes(mediaTypes[strings.ToLower(ext)], buf.Bytes())
+		if errors.Is(err, minify.ErrNotExist) {
+			data = buf.Bytes()
+		} else if err != nil {
+			return fmt.Errorf("bundle %q: %w", name, err)
+		}
+		sum := sha256.Sum256(data)
+		hashed := "/" + strings.TrimSuffix(strings.TrimPrefix(name, "/"), ext) + "." + hex.EncodeToString(sum[:8]) + ext
+		if err := b.writeFile(b.c.Dst, hashed, data); err != nil {
+			return err
+		}
+		b.bundles[name] = hashed
+	}
+	return nil
+}
+
+// bundle returns the URL of the named bundle.
+func (b *buildContext) bundle(name string) (string, error) {
+	hashed, ok := b.bundles[name]
+	if !ok {
+		return "", fmt.Errorf("unknown bundle %q", name)
+	}
+	return b.url(hashed), nil
+}
+
+// forEach calls f for each page, running at most Concurrency calls at once,
+// and returns the first error.
+func (b *buildContext) forEach(pages []*Page, f func(*Page) error) error {
+	n := b.c.Concurrency
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	var g errgroup.Group
+	g.SetLimit(n)
+	for _, p := range pages {
+		g.Go(func() error { return f(p) })
+	}
+	return g.Wait()
+}
+
+const errorPageTemplate = `<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width,initial-scale=1" />
+    <title>Build error: %[1]s</title>
+  </head>
+  <body>
+    <h1>Failed to build %[1]s</h1>
+    <pre>%[2]s</pre>
+  </body>
+</html>
+`
+
+const redirectPageTemplate = `<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width,initial-scale=1" />
+    <title>%[1]s</title>
+    <link rel="canonical" href="%[2]s" />
+    <meta http-equiv="refresh" content="0; url=%[2]s" />
+  </head>
+  <body>
+    <p>This page has moved to <a href="%[2]s">%[2]s</a>.</p>
+  </body>
+</html>
+`
+
+// pageFailed handles an error that happened when building p. If
+// ContinueOnError is set, it logs the error and writes an error page instead
+// of p to the dir directory, otherwise the error is returned.
+func (b *buildContext) pageFailed(p *Page, dir string, err error) error {
+	if !b.c.ContinueOnError {
+		return err
+	}
+	p.failed = true
+	b.warnf("%v", err)
+	doc := fmt.Sprintf(errorPageTemplate, html.EscapeString(p.Title), html.EscapeString(err.Error()))
+	if err := b.writeFile(dir, p.dstPath, []byte(doc)); err != nil {
+		return &BuildError{Path: p.path, Phase: PhaseWrite, Err: err}
+	}
+	return nil
+}
+
+// writePage builds p and writes it to the dir directory.
+func (b *buildContext) writePage(p *Page, dir string) error {
+	if p.RedirectTo != "" {
+		target := html.EscapeString(b.url(p.RedirectTo))
+		doc := fmt.Sprintf(redirectPageTemplate, html.EscapeString(p.Title), target)
+		if err := b.writeFile(dir, p.dstPath, []byte(doc)); err != nil {
+			return &BuildError{Path: p.path, Phase: PhaseWrite, Err: err}
+		}
+		return nil
+	}
+
+	tpl, ok := b.templates[p.Template]
+	if !ok {
+		return &BuildError{Path: p.path, Phase: PhaseRender, Err: fmt.Errorf("no such template %q", p.Template)}
+	}
+
+	var buf bytes.Buffer
+	if err := p.build(b, tpl, &buf); err != nil {
+		return err
+	}
+
+	if err := b.writeFile(dir, p.dstPath, b.finalNewline(buf.Bytes())); err != nil {
+		return &BuildError{Path: p.path, Phase: PhaseWrite, Err: err}
+	}
+	return nil
+}
+
+// finalNewline replaces trailing whitespace of doc with a single newline,
+// unless disabled by SkipFinalNewline.
+func (b *buildContext) finalNewline(doc []byte) []byte {
+	if b.c.SkipFinalNewline {
+		return doc
+	}
+	return append(bytes.TrimRightFunc(doc, unicode.IsSpace), '\n')
+}
+
+// writeFile writes data to the slash-separated path name inside dir. When
+// building in memory, files inside Dst are kept in memory instead.
+func (b *buildContext) writeFile(dir, name string, data []byte) error {
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	if b.mem != nil && dir == b.c.Dst {
+		return b.mem.WriteFile(name, data, b.now)
+	}
+	dst := filepath.Join(dir, filepath.FromSlash(name))
+	if b.written != nil && dir == b.c.Dst {
+		sum := sha256.Sum256(data)
+		b.writtenMu.Lock()
+		b.written[name] = sum
+		prev, ok := b.prev[name]
+		b.writtenMu.Unlock()
+		if ok && prev == sum {
+			if _, err := os.Stat(dst); err == nil {
+				return nil
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 		return err
 	}
+	return os.WriteFile(dst, data, 0o644)
+}
 
+// removeStale removes files written by the previous incremental build that
+// weren't written by this one, e.g. of deleted pages.
+func (b *buildContext) removeStale() error {
+	for name := range b.prev {
+		if _, ok := b.written[name]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(b.c.Dst, filepath.FromSlash(name))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
 	return nil
 }
 
+// parseAllPages parses all pages and sorts them by date.
+func (b *buildContext) parseAllPages() error {
+	if err := filepath.WalkDir(filepath.Join(b.c.Src, "pages"), b.parsePages); err != nil {
+		return err
+	}
+
+	// Sort pages by date, newest first. Pages without date are pushed to the
+	// end and sorted by path.
+	sort.SliceStable(b.pages, func(i, j int) bool {
+		pi, pj := b.pages[i], b.pages[j]
+		switch {
+		case pi.Date == nil && pj.Date == nil:
+			return pi.path < pj.path
+		case pi.Date == nil || pj.Date == nil:
+			return pj.Date == nil
+		}
+		return pi.Date.Time.After(pj.Date.Time)
+	})
+
+	return nil
+}
+
+// addTagPages adds a page for each tag of posts, with a list of links to posts
+// with the tag as contents, newest first. Tag pages are kept apart from other
+// pages, so they aren't listed by pages and aren't included in feeds and the
+// search index.
+func (b *buildContext) addTagPages() error {
+	var (
+		tags   []string
+		posts  = make(map[string][]*Page) // by tag slug
+		titles = make(map[string]string)  // tag by slug
+	)
+	for _, p := range b.pages {
+		if p.Type != "post" || p.RedirectTo != "" {
+			continue
+		}
+		for _, tag := range p.Tags {
+			slug := slugify(tag)
+			if slug == "" {
+				return &BuildError{Path: p.path, Phase: PhaseParse, Err: fmt.Errorf("tag %q has empty slug", tag)}
+			}
+			if other, ok := titles[slug]; !ok {
+				titles[slug] = tag
+				tags = append(tags, slug)
+			} else if other != tag {
+				return &BuildError{Path: p.path, Phase: PhaseParse, Err: fmt.Errorf("tags %q and %q have the same slug %q", other, tag, slug)}
+			}
+			posts[slug] = append(posts[slug], p)
+		}
+	}
+	sort.Strings(tags)
+
+	for _, slug := range tags {
+		tp := &Page{
+			Title:     titles[slug],
+			Permalink: "/tags/" + slug,
+			Template:  b.c.TagTemplate,
+			Type:      "tag",
+			path:      path.Join("tags", slug),
+			dstPath:   path.Join("/tags", slug+".html"),
+			b:         b,
+			rendered:  true,
+		}
+		if b.hasPage(tp.Permalink) {
+			return &BuildError{Path: tp.path, Phase: PhaseParse, Err: fmt.Errorf("tag page %s conflicts with an existing page", tp.Permalink)}
+		}
+		var buf bytes.Buffer
+		buf.WriteString("<ul>\n")
+		for _, p := range posts[slug] {
+			fmt.Fprintf(&buf, "<li><a href=\"%s\">%s</a></li>\n", template.HTMLEscapeString(p.Permalink), template.HTMLEscapeString(p.Title))
+		}
+		buf.WriteString("</ul>\n")
+		tp.html = b.absolutizeLinks(buf.Bytes())
+		b.tagPages = append(b.tagPages, tp)
+	}
+	return nil
+}
+
+// Stats represents statistics about the site content.
+type Stats struct {
+	Pages       int            `json:"pages"`                // number of pages
+	Posts       int            `json:"posts"`                // number of pages with "post" type
+	Words       int            `json:"words"`                // total number of words
+	WordsByType map[string]int `json:"words_by_type"`        // number of words per page type
+	FirstPost   *time.Time     `json:"first_post,omitempty"` // date of the oldest post
+	LastPost    *time.Time     `json:"last_post,omitempty"`  // date of the newest post
+}
+
+// ComputeStats parses and renders all pages based on the provided [Config]
+// and returns statistics about them. It doesn't write anything to Dst.
+func ComputeStats(c *Config) (*Stats, error) {
+	c.setDefaults()
+	b := newBuildContext(c)
+
+	if err := b.parseAllPages(); err != nil {
+		return nil, err
+	}
+
+	st := &Stats{WordsByType: make(map[string]int)}
+	for _, p := range b.pages {
+		if err := p.render(b); err != nil {
+			return nil, err
+		}
+		words := countWords(p.html)
+
+		st.Pages++
+		st.Words += words
+		st.WordsByType[p.Type] += words
+
+		if p.Type != "post" {
+			continue
+		}
+		st.Posts++
+		if p.Date == nil || p.Date.IsZero() {
+			continue
+		}
+		if st.FirstPost == nil || p.Date.Before(*st.FirstPost) {
+			st.FirstPost = &p.Date.Time
+		}
+		if st.LastPost == nil || p.Date.After(*st.LastPost) {
+			st.LastPost = &p.Date.Time
+		}
+	}
+
+	return st, nil
+}
+
+// SiteModel is a structured description of a site, returned by [Analyze].
+type SiteModel struct {
+	Pages  []*PageModel      `json:"pages"`  // pages sorted by date, like in Build
+	Static map[string]string `json:"static"` // static file path to its URL
+}
+
+// PageModel describes a single page in a [SiteModel].
+type PageModel struct {
+	Title     string     `json:"title"`
+	Permalink string     `json:"permalink"`
+	URL       string     `json:"url"` // resolved permalink
+	Type      string     `json:"type,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Date      *time.Time `json:"date,omitempty"`
+	Draft     bool       `json:"draft,omitempty"`
+	WordCount int        `json:"word_count"`
+	Source    string     `json:"source"` // path to the page source
+}
+
+// Analyze parses and renders all pages based on the provided [Config] and
+// returns a model of the site. It doesn't write anything to Dst.
+func Analyze(c *Config) (*SiteModel, error) {
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	b := newBuildContext(c)
+
+	if err := b.parseAllPages(); err != nil {
+		return nil, err
+	}
+
+	m := &SiteModel{Static: make(map[string]string)}
+	for _, p := range b.pages {
+		if err := p.render(b); err != nil {
+			return nil, err
+		}
+		pm := &PageModel{
+			Title:     p.Title,
+			Permalink: p.Permalink,
+			URL:       p.URL(),
+			Type:      p.Type,
+			Tags:      p.Tags,
+			Draft:     p.Draft,
+			WordCount: p.WordCount(),
+			Source:    p.path,
+		}
+		if p.Date != nil && !p.Date.IsZero() {
+			pm.Date = &p.Date.Time
+		}
+		m.Pages = append(m.Pages, pm)
+	}
+
+	static := os.DirFS(filepath.Join(c.Src, "static"))
+	if err := fs.WalkDir(static, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		m.Static[name] = b.url("/" + name)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+var (
+	htmlTagRe      = regexp.MustCompile(`<[^>]*>`)
+	htmlBlockTagRe = regexp.MustCompile(`(?i)</?(?:article|blockquote|br|dd|div|dl|dt|figcaption|figure|footer|h[1-6]|header|hr|li|main|nav|ol|p|pre|section|table|td|th|tr|ul)\b[^>]*>`)
+)
+
+// plainText strips HTML tags and heading anchor links from doc and collapses
+// whitespace. Block-level tags separate words, inline ones don't.
+func plainText(doc []byte) string {
+	doc = headingAnchorRe.ReplaceAll(doc, nil)
+	text := htmlBlockTagRe.ReplaceAllString(string(doc), " ")
+	text = htmlTagRe.ReplaceAllString(text, "")
+	return strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+}
+
+// countWords counts words in doc, ignoring HTML tags and standalone
+// punctuation.
+func countWords(doc []byte) int {
+	var n int
+	for _, f := range strings.Fields(plainText(doc)) {
+		if strings.IndexFunc(f, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0 {
+			n++
+		}
+	}
+	return n
+}
+
 var serveReadyHook func() // used in tests, called when Serve started serving the site
 
 // Serve builds the site and starts serving it on a provided host:port.
 func Serve(ctx context.Context, c *Config, addr string) error {
 	c.setDefaults()
 
+	h := &staticHandler{c: c, buildErr: new(atomic.Pointer[error])}
+	// Reload pages after rebuilds, unless serving a production build or
+	// another directory that rebuilds don't affect.
+	if !c.Prod && c.ServeDir == "" {
+		h.reload = newReloadBroker()
+	}
+	// Rebuild incrementally, so unchanged pages are not rendered again and
+	// unchanged files are not rewritten.
+	state := new(outputState)
+	rebuild := func() error {
+		_, _, err := build(c, false, state)
+		return err
+	}
+	if c.ServeFromMemory {
+		h.live = new(atomic.Pointer[fs.FS])
+		var empty fs.FS = new(memfs.FS)
+		h.live.Store(&empty)
+		rebuild = func() error {
+			fsys, err := BuildToFS(c)
+			if err != nil {
+				return err
+			}
+			h.live.Store(&fsys)
+			return nil
+		}
+	}
+
+	// Remember the last build error, so it's shown in the browser instead of
+	// stale pages.
+	buildSite := rebuild
+	rebuild = func() error {
+		err := buildSite()
+		if err != nil {
+			h.buildErr.Store(&err)
+		} else {
+			h.buildErr.Store(nil)
+		}
+		return err
+	}
+
 	c.Logf("Performing an initial build...")
-	if err := Build(c); err != nil {
+	if err := rebuild(); err != nil {
 		c.Logf("Initial build failed: %v", err)
 	}
 
@@ -245,9 +1642,30 @@ func Serve(ctx context.Context, c *Config, addr string) error {
 		return err
 	}
 	defer l.Close()
-	c.Logf("Listening on http://%s...", l.Addr().String())
+	scheme := "http"
+	if c.ServeTLS {
+		cfg, err := c.tlsConfig()
+		if err != nil {
+			return err
+		}
+		l = tls.NewListener(l, cfg)
+		scheme = "https"
+	}
+	c.Logf("Listening on %s://%s...", scheme, l.Addr().String())
 
-	httpSrv := &http.Server{Handler: &staticHandler{fs: os.DirFS(c.Dst)}}
+	dir := c.Dst
+	if c.ServeDir != "" {
+		dir = c.ServeDir
+	}
+	h.fs = os.DirFS(dir)
+	var handler http.Handler = h
+	if c.AccessLog != nil {
+		handler = &accessLogHandler{h: h, w: c.AccessLog}
+	}
+	httpSrv := &http.Server{Handler: handler}
+	if h.reload != nil {
+		httpSrv.RegisterOnShutdown(h.reload.close)
+	}
 	errCh := make(chan error, 1)
 	go func() {
 		if err := httpSrv.Serve(l); err != nil {
@@ -260,12 +1678,18 @@ func Serve(ctx context.Context, c *Config, addr string) error {
 	go func() {
 		c.Logf("Started watching for new changes.")
 
-		// FIXME: Debounce closer changes.
-
 		var (
 			changes   = make(chan struct{}, 1) // buffered to avoid blocking
 			buildDone = make(chan struct{})    // signals when a build is done
+			settled   = make(chan struct{}, 1) // signals when changes settled
 		)
+		deb := newDebouncer(cmp.Or(c.ServeDebounce, defaultServeDebounce), func() {
+			select {
+			case settled <- struct{}{}:
+			default: // already signaled
+			}
+		})
+		defer deb.stop()
 
 		go func() {
 			defer close(changes)
@@ -275,16 +1699,28 @@ func Serve(ctx context.Context, c *Config, addr string) error {
 			for {
 				select {
 				case event := <-watcher.Events:
+					// Watch new directories, like a new section in pages.
+					if event.Op&fsnotify.Create != 0 {
+						if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+							if err := watchRecursive(watcher, event.Name); err != nil {
+								c.Logf("Failed to watch %s: %v", event.Name, err)
+							}
+						}
+					}
+
 					if !shouldRebuild(event.Name, event.Op) {
 						continue
 					}
 
+					c.Logf("Detected change %s (%v).", event.Name, event.Op)
+					deb.Do()
+				case <-settled:
 					if pending {
-						c.Logf("Detected change %s (%v), but build is in progress.", event.Name, event.Op)
+						c.Logf("Changes settled, but build is in progress.")
 						continue
 					}
 
-					c.Logf("Detected change %s (%v), triggering build.", event.Name, event.Op)
+					c.Logf("Changes settled, triggering build.")
 					pending = true
 					changes <- struct{}{}
 				case <-buildDone:
@@ -308,9 +1744,14 @@ func Serve(ctx context.Context, c *Config, addr string) error {
 			for {
 				select {
 				case <-changes:
-					if err := Build(c); err != nil {
+					if err := rebuild(); err != nil {
 						c.Logf("Failed to rebuild the site: %v", err)
 					}
+					// Reload pages either way, to show or clear the build
+					// error.
+					if h.reload != nil {
+						h.reload.notify()
+					}
 					buildDone <- struct{}{}
 				case <-ctx.Done():
 					return
@@ -336,6 +1777,90 @@ func Serve(ctx context.Context, c *Config, addr string) error {
 	return httpSrv.Shutdown(shutdownCtx)
 }
 
+// tlsConfig returns a TLS configuration for Serve with the certificate from
+// TLSCertFile and TLSKeyFile, or a generated self-signed one.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+	cert, err := selfSignedCert()
+	if err != nil {
+		return nil, fmt.Errorf("generating self-signed certificate: %w", err)
+	}
+	c.Logf("Using a self-signed certificate for localhost.")
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// selfSignedCert generates a self-signed certificate for localhost, valid for
+// a year, so it doesn't expire while Serve is running.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// defaultServeDebounce is how long Serve waits for file changes to settle,
+// unless overridden by Config.ServeDebounce.
+const defaultServeDebounce = 250 * time.Millisecond
+
+// debouncer calls a function once calls to Do stop for an interval.
+type debouncer struct {
+	d time.Duration
+	f func()
+
+	mu sync.Mutex
+	t  *time.Timer
+}
+
+func newDebouncer(d time.Duration, f func()) *debouncer {
+	return &debouncer{d: d, f: f}
+}
+
+// Do schedules a call after the interval, cancelling a pending one.
+func (db *debouncer) Do() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.t != nil {
+		db.t.Stop()
+	}
+	db.t = time.AfterFunc(db.d, db.f)
+}
+
+// stop cancels a pending call, if any.
+func (db *debouncer) stop() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.t != nil {
+		db.t.Stop()
+	}
+}
+
 func watchRecursive(w *fsnotify.Watcher, dir string) error {
 	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -395,11 +1920,46 @@ func shouldRebuild(path string, op fsnotify.Op) bool {
 }
 
 type staticHandler struct {
-	fs fs.FS
+	fs     fs.FS
+	live   *atomic.Pointer[fs.FS] // if set, replaces fs; swapped after rebuilds
+	c      *Config
+	reload *reloadBroker // if set, HTML pages are reloaded after rebuilds
+
+	buildErr *atomic.Pointer[error] // if set, holds the last build error, if any
 }
 
 func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.live != nil {
+		// Take a snapshot, so the whole request is served from the same build.
+		snapshot := &staticHandler{fs: *h.live.Load(), c: h.c, reload: h.reload, buildErr: h.buildErr}
+		snapshot.ServeHTTP(w, r)
+		return
+	}
+
 	p := r.URL.Path
+	if h.c != nil && h.c.BasePathStrip != "" {
+		prefix := "/" + strings.Trim(h.c.BasePathStrip, "/")
+		rest, ok := strings.CutPrefix(p, prefix)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			h.serveNotFound(w, r)
+			return
+		}
+		p = rest
+		if p == "" {
+			p = "/"
+		}
+	}
+	if p == reloadPath && h.reload != nil {
+		h.reload.ServeHTTP(w, r)
+		return
+	}
+	if h.buildErr != nil && isNavigation(r) {
+		if err := h.buildErr.Load(); err != nil {
+			h.serveBuildError(w, *err)
+			return
+		}
+	}
+	reqPath := p
 	if p == "/" {
 		p += "/index.html"
 	}
@@ -411,17 +1971,16 @@ func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	d, err := fs.Stat(h.fs, p)
-	if errors.Is(err, fs.ErrNotExist) {
-		h.serveNotFound(w, r)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && d.IsDir()) {
+		// Like Netlify, apply redirect rules only if there is no file.
+		if !h.redirect(w, r, reqPath) {
+			h.serveNotFound(w, r)
+		}
 		return
 	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if d.IsDir() {
-		h.serveNotFound(w, r)
-		return
-	}
 
 	b, err := fs.ReadFile(h.fs, p)
 	if err != nil {
@@ -429,9 +1988,224 @@ func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if path.Ext(p) == ".html" && h.c != nil {
+		if links := h.c.endpointLinks(); len(links) > 0 {
+			var hdr []string
+			for _, l := range links {
+				hdr = append(hdr, fmt.Sprintf("<%s>; rel=%q", l.href, l.rel))
+			}
+			w.Header().Set("Link", strings.Join(hdr, ", "))
+		}
+	}
+
+	if path.Ext(p) == ".html" && h.reload != nil {
+		b = injectReloadScript(b, h.c)
+	}
+
+	// Rebuilding gives files a new modification time even if their contents
+	// didn't change, so set ETag derived from the contents to let ServeContent
+	// answer conditional requests, e.g. from feed readers, across rebuilds.
+	sum := sha256.Sum256(b)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
 	http.ServeContent(w, r, d.Name(), d.ModTime(), bytes.NewReader(b))
 }
 
+// isNavigation reports whether r is likely a browser navigation to an HTML
+// page.
+func isNavigation(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Header.Get("Sec-Fetch-Mode") == "navigate" || strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// serveBuildError serves an error page with err instead of a stale page, so
+// the failed build is noticed. The page reloads after the next rebuild.
+func (h *staticHandler) serveBuildError(w http.ResponseWriter, err error) {
+	doc := []byte(fmt.Sprintf(errorPageTemplate, "the site", html.EscapeString(err.Error())))
+	if h.reload != nil {
+		doc = injectReloadScript(doc, h.c)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(doc)
+}
+
+// reloadPath is the path of the Server-Sent Events endpoint that notifies
+// pages about rebuilds.
+const reloadPath = "/_reload"
+
+// reloadBroker notifies connected pages about rebuilds with Server-Sent
+// Events.
+type reloadBroker struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]bool
+	done    chan struct{} // closed on shutdown
+	closed  bool
+}
+
+func newReloadBroker() *reloadBroker {
+	return &reloadBroker{
+		clients: make(map[chan struct{}]bool),
+		done:    make(chan struct{}),
+	}
+}
+
+// notify sends a reload event to all connected clients.
+func (rb *reloadBroker) notify() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for ch := range rb.clients {
+		select {
+		case ch <- struct{}{}:
+		default: // already has a pending event
+		}
+	}
+}
+
+// close disconnects all clients, so the server can shut down.
+func (rb *reloadBroker) close() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if !rb.closed {
+		rb.closed = true
+		close(rb.done)
+	}
+}
+
+func (rb *reloadBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan struct{}, 1)
+	rb.mu.Lock()
+	rb.clients[ch] = true
+	rb.mu.Unlock()
+	defer func() {
+		rb.mu.Lock()
+		delete(rb.clients, ch)
+		rb.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-ch:
+			io.WriteString(w, "event: reload\ndata: {}\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-rb.done:
+			return
+		}
+	}
+}
+
+// injectReloadScript adds a script that reloads the page after rebuilds to
+// doc, right before the closing body tag, or at the end if there is none.
+func injectReloadScript(doc []byte, c *Config) []byte {
+	endpoint := reloadPath
+	if c != nil && c.BasePathStrip != "" {
+		endpoint = "/" + strings.Trim(c.BasePathStrip, "/") + reloadPath
+	}
+	script := []byte(fmt.Sprintf(`<script>new EventSource(%q).addEventListener("reload", () => location.reload());</script>`, endpoint))
+	i := bytes.LastIndex(doc, []byte("</body>"))
+	if i < 0 {
+		return append(doc, script...)
+	}
+	return slices.Concat(doc[:i], script, doc[i:])
+}
+
+// accessLogHandler writes requests handled by h to w in Combined Log Format.
+type accessLogHandler struct {
+	h  http.Handler
+	mu sync.Mutex // protects w
+	w  io.Writer
+}
+
+func (h *accessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+	h.h.ServeHTTP(rw, r)
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	line := fmt.Sprintf("%s - - [%s] %q %d %d %q %q\n",
+		host,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+		rw.status,
+		rw.size,
+		dash(r.Referer()),
+		dash(r.UserAgent()),
+	)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	io.WriteString(h.w, line)
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// Flush implements http.Flusher, so streaming responses like live reload
+// events work with the access log.
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// redirect redirects the request if path matches one of the redirect rules
+// and reports whether it did.
+func (h *staticHandler) redirect(w http.ResponseWriter, r *http.Request, path string) bool {
+	if h.c == nil {
+		return false
+	}
+	for _, rule := range h.c.RedirectRules {
+		if to, ok := rule.match(path); ok {
+			http.Redirect(w, r, to, rule.status())
+			return true
+		}
+	}
+	return false
+}
+
 func (h *staticHandler) serveNotFound(w http.ResponseWriter, r *http.Request) {
 	f, err := h.fs.Open("404.html")
 	if errors.Is(err, fs.ErrNotExist) {
@@ -447,47 +2221,231 @@ func (h *staticHandler) serveNotFound(w http.ResponseWriter, r *http.Request) {
 }
 
 type buildContext struct {
-	c         *Config
-	md        *markdown.Parser
-	funcs     template.FuncMap
-	pages     []*Page
-	templates map[string]*template.Template
+	c             *Config
+	md            *markdown.Parser
+	funcs         template.FuncMap
+	pages         []*Page
+	drafts        []*Page // drafts excluded from production build, see DraftsDst
+	templates     map[string]*template.Template
+	warnings      []string
+	navWarned     map[string]bool              // navigation links already warned about, see CheckNavLinks
+	paginated     []*Page                      // pages after the first of paginated listings
+	tagPages      []*Page                      // generated tag pages, see TagTemplate
+	bundles       map[string]string            // bundle name to its content-addressed path, see Bundles
+	mem           *memfs.FS                    // output when building in memory, see BuildToFS
+	usesTOC       bool                         // some template calls toc, see autoHeadingIDs
+	state         *outputState                 // state of the previous build, if incremental
+	writtenMu     sync.Mutex                   // protects written, renders and renderedPaths
+	prev          map[string][sha256.Size]byte // hashes of files written by the previous build, see outputState
+	written       map[string][sha256.Size]byte // hashes of files written by this build, if incremental
+	renders       map[string]*renderedPage     // pages rendered or reused by this build, if incremental
+	renderedPaths []string                     // sources of pages rendered by this build, if incremental
+	now           time.Time                    // when the build started
+}
+
+// warnf logs a build warning and records it.
+func (b *buildContext) warnf(format string, args ...any) {
+	w := fmt.Sprintf(format, args...)
+	b.warnings = append(b.warnings, w)
+	b.c.Logf("Warning: %s", w)
 }
 
 func newBuildContext(c *Config) *buildContext {
 	b := &buildContext{
-		c: c,
-		md: &markdown.Parser{
-			HeadingID:          true,
-			Strikethrough:      true,
-			TaskList:           true,
-			AutoLinkText:       true,
-			AutoLinkAssumeHTTP: true,
-			Table:              true,
-			Emoji:              true,
-			SmartDot:           true,
-			SmartDash:          true,
-			SmartQuote:         true,
-			Footnote:           true,
-		},
+		c:         c,
+		now:       time.Now(),
+		navWarned: make(map[string]bool),
+		md:        newMarkdownParser(c.Markdown),
 		templates: make(map[string]*template.Template),
 	}
 
 	b.funcs = template.FuncMap{
-		"content":   func(p *Page) template.HTML { return template.HTML(p.contents) },
-		"time":      b.time,
-		"icon":      b.icon,
-		"image":     b.image,
-		"navLink":   b.navLink,
-		"pages":     b.pagesByType,
-		"url":       b.url,
-		"vanity":    func() bool { return b.c.Vanity },
-		"vanityURL": b.vanityURL,
+		"bodyClass":       bodyClass,
+		"bundle":          b.bundle,
+		"content":         func(p *Page) template.HTML { return template.HTML(p.html) },
+		"excerpt":         b.excerpt,
+		"feature":         func(name string) bool { return b.c.Features[name] },
+		"feedLinks":       b.feedLinks,
+		"time":            b.time,
+		"toc":             toc,
+		"icon":            b.icon,
+		"isDraft":         func(p *Page) bool { return b.unpublished(p) && !b.c.Prod },
+		"image":           b.image,
+		"navLink":         b.navLink,
+		"ogImage":         b.ogImage,
+		"openGraph":       b.openGraph,
+		"pages":           b.pagesByType,
+		"paginate":        b.paginate,
+		"preloadLinks":    b.preloadLinks,
+		"readingTime":     b.readingTime,
+		"renderPage":      b.renderPage,
+		"scripts":         b.scripts,
+		"url":             b.url,
+		"vanity":          func() bool { return b.c.Vanity },
+		"vanityURL":       b.vanityURL,
+		"webmentionLinks": b.webmentionLinks,
+		"wordCount":       b.wordCount,
 	}
 
 	return b
 }
 
+// newMarkdownParser returns a Markdown parser with extensions from opts.
+func newMarkdownParser(opts MarkdownOptions) *markdown.Parser {
+	return &markdown.Parser{
+		HeadingID:          !opts.DisableHeadingID,
+		Strikethrough:      !opts.DisableStrikethrough,
+		TaskList:           !opts.DisableTaskList,
+		AutoLinkText:       !opts.DisableAutoLinkText,
+		AutoLinkAssumeHTTP: !opts.DisableAutoLinkAssumeHTTP,
+		Table:              !opts.DisableTable,
+		Emoji:              !opts.DisableEmoji,
+		SmartDot:           !opts.DisableSmartDot,
+		SmartDash:          !opts.DisableSmartDash,
+		SmartQuote:         !opts.DisableSmartQuote,
+		Footnote:           !opts.DisableFootnote,
+	}
+}
+
+type endpointLink struct {
+	rel, href string
+}
+
+// endpointLinks returns IndieWeb endpoints that pages should advertise.
+func (c *Config) endpointLinks() []endpointLink {
+	var links []endpointLink
+	if c.WebmentionEndpoint != "" {
+		links = append(links, endpointLink{"webmention", c.WebmentionEndpoint})
+	}
+	if c.MicropubEndpoint != "" {
+		links = append(links, endpointLink{"micropub", c.MicropubEndpoint})
+	}
+	return links
+}
+
+func (b *buildContext) webmentionLinks() template.HTML {
+	var links []string
+	for _, l := range b.c.endpointLinks() {
+		links = append(links, fmt.Sprintf(`<link rel="%s" href="%s" />`, l.rel, template.HTMLEscapeString(l.href)))
+	}
+	return template.HTML(strings.Join(links, "\n"))
+}
+
+func (b *buildContext) preloadLinks(p *Page) template.HTML {
+	if !b.c.Preload && !p.Preload {
+		return ""
+	}
+	var links []string
+	for _, css := range p.CSS {
+		links = append(links, fmt.Sprintf(`<link rel="preload" href="%s" as="style" />`, template.HTMLEscapeString(b.url(css))))
+	}
+	for _, js := range p.JS {
+		rel := "preload"
+		if js.Module {
+			rel = "modulepreload"
+		}
+		links = append(links, fmt.Sprintf(`<link rel="%s" href="%s" as="script" />`, rel, template.HTMLEscapeString(b.url(js.Src))))
+	}
+	return template.HTML(strings.Join(links, "\n"))
+}
+
+// ogImage returns the URL of the Open Graph image of the page, either set in
+// front matter or generated, or an empty string if there is none.
+func (b *buildContext) ogImage(p *Page) string {
+	switch {
+	case p.Image != "":
+		return b.url(p.Image)
+	case p.ogImage != "":
+		return b.url(p.ogImage)
+	}
+	return ""
+}
+
+// openGraph returns Open Graph and Twitter Card meta tags for the page.
+func (b *buildContext) openGraph(p *Page) template.HTML {
+	typ := "website"
+	if p.Type == "post" {
+		typ = "article"
+	}
+	tags := [][2]string{
+		{"og:title", p.Title},
+		{"og:url", b.absURL(p.Permalink)},
+		{"og:type", typ},
+	}
+	if p.Summary != "" {
+		tags = append(tags, [2]string{"og:description", p.Summary})
+	}
+	card := "summary"
+	if img := b.ogImage(p); img != "" {
+		tags = append(tags, [2]string{"og:image", b.absURL(img)})
+		card = "summary_large_image"
+	}
+
+	var sb strings.Builder
+	for _, tag := range tags {
+		fmt.Fprintf(&sb, "<meta property=%q content=\"%s\" />\n", tag[0], template.HTMLEscapeString(tag[1]))
+	}
+	fmt.Fprintf(&sb, `<meta name="twitter:card" content="%s" />`, card)
+	return template.HTML(sb.String())
+}
+
+// bodyClass returns classes for the body element of the page, derived from
+// its type and tags, unless overridden by the body_class front matter field.
+func bodyClass(p *Page) string {
+	if p.BodyClass != "" {
+		return p.BodyClass
+	}
+	typ := p.Type
+	if typ == "" {
+		typ = "page"
+	}
+	classes := []string{"page", "type-" + slugify(typ)}
+	for _, tag := range p.Tags {
+		if slug := slugify(tag); slug != "" {
+			classes = append(classes, "tag-"+slug)
+		}
+	}
+	return strings.Join(classes, " ")
+}
+
+// slugify lowercases s and replaces runs of characters other than letters and
+// digits with a single dash.
+func slugify(s string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	return sb.String()
+}
+
+// scripts returns script elements for JavaScript files of p.
+func (b *buildContext) scripts(p *Page) template.HTML {
+	var tags []string
+	for _, js := range p.JS {
+		var attrs string
+		if js.Module {
+			attrs += ` type="module"`
+		}
+		if js.Defer {
+			attrs += " defer"
+		}
+		if js.Async {
+			attrs += " async"
+		}
+		tags = append(tags, fmt.Sprintf(`<script%s src="%s"></script>`, attrs, template.HTMLEscapeString(b.url(js.Src))))
+	}
+	return template.HTML(strings.Join(tags, "\n"))
+}
+
 func (b *buildContext) icon(name string) template.HTML {
 	return template.HTML(fmt.Sprintf(`
 <svg class="icon" aria-hidden="true">
@@ -504,7 +2462,20 @@ func (b *buildContext) image(path, caption string) template.HTML {
 	return template.HTML(s)
 }
 
-func (b *buildContext) navLink(p *Page, title, iconName, path string) template.HTML {
+func (b *buildContext) navLink(p *Page, title, iconName, path string) (template.HTML, error) {
+	if b.c.CheckNavLinks != "" && !b.c.Vanity && !isFullURL(path) && !b.hasPage(path) {
+		if b.c.CheckNavLinks == "strict" {
+			return "", fmt.Errorf("navigation link %q points to a page that isn't built", path)
+		}
+		if !b.navWarned[path] {
+			b.navWarned[path] = true
+			b.warnf("navigation link %q points to a page that isn't built", path)
+		}
+		if b.c.CheckNavLinks == "skip" {
+			return "", nil
+		}
+	}
+
 	var add string
 	// On vanity site always highlight packages link.
 	if p.Permalink == path || (b.c.Vanity && path == "https://go.astrophena.name") {
@@ -516,16 +2487,426 @@ func (b *buildContext) navLink(p *Page, title, iconName, path string) template.H
 	} else {
 		u = b.url(path)
 	}
-	return template.HTML(fmt.Sprintf(`<a href="%s"%s>%s%s</a>`, u, add, b.icon(iconName), title))
+	return template.HTML(fmt.Sprintf(`<a href="%s"%s>%s%s</a>`, u, add, b.icon(iconName), title)), nil
+}
+
+// autoHeadingIDs reports whether headings without an explicit {#id} get IDs
+// derived from their text. They are only needed for tables of contents, so
+// they are added only when heading IDs are enabled and a template uses toc.
+func (b *buildContext) autoHeadingIDs() bool {
+	return b.md.HeadingID && b.usesTOC
+}
+
+// addHeadingIDs sets IDs derived from heading text on top-level headings in
+// doc that don't have an explicit {#id}, so they can be linked to, e.g. from
+// a table of contents.
+func addHeadingIDs(doc *markdown.Document) {
+	seen := make(map[string]bool)
+	for _, blk := range doc.Blocks {
+		if h, ok := blk.(*markdown.Heading); ok && h.ID != "" {
+			seen[h.ID] = true
+		}
+	}
+	for _, blk := range doc.Blocks {
+		h, ok := blk.(*markdown.Heading)
+		if !ok || h.ID != "" {
+			continue
+		}
+		base := slugify(plainText([]byte(markdown.ToHTML(h.Text))))
+		if base == "" {
+			base = "section"
+		}
+		id := base
+		for i := 1; seen[id]; i++ {
+			id = fmt.Sprintf("%s-%d", base, i)
+		}
+		seen[id] = true
+		h.ID = id
+	}
+}
+
+var (
+	anchorHeadingRe = regexp.MustCompile(`(?s)(<h[2-4]\b[^>]*\bid="([^"]+)"[^>]*>.*?)(</h[2-4]>)`)
+	preBlockRe      = regexp.MustCompile(`(?s)<pre\b.*?</pre>`)
+	headingAnchorRe = regexp.MustCompile(` <a class="anchor" href="#[^"]*">#</a>`)
+)
+
+// addHeadingAnchors appends anchor links to h2–h4 headings with IDs in doc,
+// leaving contents of pre elements alone.
+func addHeadingAnchors(doc []byte) []byte {
+	var buf bytes.Buffer
+	add := func(b []byte) {
+		buf.Write(anchorHeadingRe.ReplaceAll(b, []byte(`$1 <a class="anchor" href="#$2">#</a>$3`)))
+	}
+	last := 0
+	for _, loc := range preBlockRe.FindAllIndex(doc, -1) {
+		add(doc[last:loc[0]])
+		buf.Write(doc[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	add(doc[last:])
+	return buf.Bytes()
+}
+
+var (
+	emojiSkipRe      = regexp.MustCompile(`(?s)<pre\b.*?</pre>|<code\b.*?</code>|<[^>]*>`)
+	emojiShortcodeRe = regexp.MustCompile(`:([a-zA-Z0-9_+-]+):`)
+)
+
+// expandEmoji replaces shortcodes from Config.Emoji in text of doc, leaving
+// contents of code and pre elements and tags alone.
+func (b *buildContext) expandEmoji(doc []byte) []byte {
+	expand := func(text []byte) []byte {
+		return emojiShortcodeRe.ReplaceAllFunc(text, func(match []byte) []byte {
+			name := string(match[1 : len(match)-1])
+			v, ok := b.c.Emoji[name]
+			if !ok {
+				return match
+			}
+			if strings.HasPrefix(v, "/") || isFullURL(v) {
+				return []byte(fmt.Sprintf(`<img class="emoji" src="%s" alt=":%s:">`, html.EscapeString(b.url(v)), html.EscapeString(name)))
+			}
+			return []byte(html.EscapeString(v))
+		})
+	}
+	var buf bytes.Buffer
+	last := 0
+	for _, loc := range emojiSkipRe.FindAllIndex(doc, -1) {
+		buf.Write(expand(doc[last:loc[0]]))
+		buf.Write(doc[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	buf.Write(expand(doc[last:]))
+	return buf.Bytes()
+}
+
+// mathSpan is TeX math extracted from Markdown source by extractMath.
+type mathSpan struct {
+	tex     string
+	display bool // delimited by $$
+}
+
+// mathPlaceholder returns a placeholder for the i-th math span. It uses
+// private use characters that Markdown leaves alone.
+func mathPlaceholder(i int) string {
+	return "\uE000" + strconv.Itoa(i) + "\uE001"
+}
+
+var (
+	codeFenceRe       = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+	indentedCodeRe    = regexp.MustCompile(`^( {4}|\t)`)
+	mathPlaceholderRe = regexp.MustCompile("(<p>)?\uE000([0-9]+)\uE001(</p>)?")
+)
+
+// extractMath replaces inline $...$ and display $$...$$ math in Markdown src
+// with placeholders, so the Markdown parser doesn't mangle TeX. Dollar signs
+// in code blocks and code spans, and escaped ones, are left alone.
+func extractMath(src string) (string, []mathSpan) {
+	var (
+		sb    strings.Builder
+		spans []mathSpan
+		text  strings.Builder // pending lines outside code blocks
+		fence string          // opening fence of the current code block
+		blank = true          // previous line is blank
+	)
+	flush := func() {
+		sb.WriteString(replaceMath(text.String(), &spans))
+		text.Reset()
+	}
+	for _, line := range strings.SplitAfter(src, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fence != "":
+			if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+				fence = ""
+			}
+			sb.WriteString(line)
+		case codeFenceRe.MatchString(line):
+			flush()
+			fence = codeFenceRe.FindStringSubmatch(line)[1]
+			sb.WriteString(line)
+		case blank && indentedCodeRe.MatchString(line) && trimmed != "":
+			flush()
+			sb.WriteString(line)
+			continue // an indented code block continues until a blank line
+		default:
+			text.WriteString(line)
+		}
+		blank = trimmed == ""
+	}
+	flush()
+	return sb.String(), spans
+}
+
+// replaceMath replaces math in text outside code blocks with placeholders,
+// appending extracted math to spans.
+func replaceMath(text string, spans *[]mathSpan) string {
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text):
+			sb.WriteString(text[i : i+2])
+			i++
+		case c == '`':
+			// Copy a code span verbatim up to the closing run of backticks of
+			// the same length.
+			n := len(text[i:]) - len(strings.TrimLeft(text[i:], "`"))
+			run := text[i : i+n]
+			end := strings.Index(text[i+n:], run)
+			if end < 0 {
+				sb.WriteString(run)
+				i += n - 1
+				continue
+			}
+			end += i + 2*n
+			sb.WriteString(text[i:end])
+			i = end - 1
+		case strings.HasPrefix(text[i:], "$$"):
+			end := strings.Index(text[i+2:], "$$")
+			if end < 0 {
+				sb.WriteString("$$")
+				i++
+				continue
+			}
+			sb.WriteString(mathPlaceholder(len(*spans)))
+			*spans = append(*spans, mathSpan{tex: strings.TrimSpace(text[i+2 : i+2+end]), display: true})
+			i += end + 3
+		case c == '$':
+			// Like Pandoc, require non-space after the opening and before the
+			// closing dollar sign, so amounts like $5 and $10 stay as is.
+			line, _, _ := strings.Cut(text[i+1:], "\n")
+			end := closingDollar(line)
+			if end <= 0 || line[0] == ' ' || line[end-1] == ' ' || (end+1 < len(line) && unicode.IsDigit(rune(line[end+1]))) {
+				sb.WriteByte(c)
+				continue
+			}
+			sb.WriteString(mathPlaceholder(len(*spans)))
+			*spans = append(*spans, mathSpan{tex: line[:end]})
+			i += end + 1
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// closingDollar returns the index of the first unescaped dollar sign in s, or
+// -1 if there is none.
+func closingDollar(s string) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '$':
+			return i
+		}
+	}
+	return -1
+}
+
+// insertMath replaces placeholders left by extractMath in doc with math
+// wrapped in elements for a client-side renderer like KaTeX: display math
+// that makes up a whole paragraph becomes <div class="math">, other math
+// <span class="math">.
+func insertMath(doc []byte, spans []mathSpan) []byte {
+	return mathPlaceholderRe.ReplaceAllFunc(doc, func(match []byte) []byte {
+		sm := mathPlaceholderRe.FindSubmatch(match)
+		i, err := strconv.Atoi(string(sm[2]))
+		if err != nil || i >= len(spans) {
+			return match
+		}
+		tex := html.EscapeString(spans[i].tex)
+		if spans[i].display && len(sm[1]) > 0 && len(sm[3]) > 0 {
+			return []byte(`<div class="math">` + tex + `</div>`)
+		}
+		return []byte(string(sm[1]) + `<span class="math">` + tex + `</span>` + string(sm[3]))
+	})
+}
+
+var tocHeadingRe = regexp.MustCompile(`(?s)<h([1-6])\b[^>]*\bid="([^"]+)"[^>]*>(.*?)</h[1-6]>`)
+
+// toc returns a table of contents of the rendered page as nested lists of
+// links to headings up to level maxLevel, e.g. {{ toc . 3 }} includes h1, h2
+// and h3. It's meant for layouts, since page contents are rendered after
+// executing templates in them. When some template calls toc, Markdown
+// headings without an explicit {#id} get IDs derived from their text.
+func toc(p *Page, maxLevel int) template.HTML {
+	var (
+		sb     strings.Builder
+		levels []int // levels of open lists
+	)
+	for _, m := range tocHeadingRe.FindAllSubmatch(p.html, -1) {
+		level := int(m[1][0] - '0')
+		if level > maxLevel {
+			continue
+		}
+		switch {
+		case len(levels) == 0:
+			sb.WriteString("<ul>\n<li>")
+			levels = append(levels, level)
+		case level > levels[len(levels)-1]:
+			sb.WriteString("\n<ul>\n<li>")
+			levels = append(levels, level)
+		default:
+			for len(levels) > 1 && level < levels[len(levels)-1] {
+				sb.WriteString("</li>\n</ul>")
+				levels = levels[:len(levels)-1]
+			}
+			sb.WriteString("</li>\n<li>")
+		}
+		fmt.Fprintf(&sb, `<a href="#%s">%s</a>`, m[2], template.HTMLEscapeString(plainText(m[3])))
+	}
+	for range levels {
+		sb.WriteString("</li>\n</ul>")
+	}
+	return template.HTML(sb.String())
+}
+
+// renderFor renders p, if needed, for the template function fn that needs the
+// rendered contents. Such functions can't be called from the page itself, only
+// from a layout or other pages.
+func (b *buildContext) renderFor(fn string, p *Page) error {
+	if p.rendering {
+		return fmt.Errorf("%s can't be called before the page is rendered, call it from a layout", fn)
+	}
+	return p.render(b)
+}
+
+// readingTime returns the estimated reading time of p in minutes, rounded up.
+func (b *buildContext) readingTime(p *Page) (int, error) {
+	if err := b.renderFor("readingTime", p); err != nil {
+		return 0, err
+	}
+	return p.ReadingTime(), nil
+}
+
+// wordCount returns the number of words in the rendered contents of p.
+func (b *buildContext) wordCount(p *Page) (int, error) {
+	if err := b.renderFor("wordCount", p); err != nil {
+		return 0, err
+	}
+	return p.WordCount(), nil
+}
+
+var firstParagraphRe = regexp.MustCompile(`(?s)<p\b[^>]*>(.*?)</p>`)
+
+// excerpt returns the rendered contents of p before the <!-- more --> marker,
+// if any. Otherwise it returns the summary of p, if set, or the contents of
+// the first paragraph of p, ignoring ones in pre elements.
+func (b *buildContext) excerpt(p *Page) (template.HTML, error) {
+	if err := b.renderFor("excerpt", p); err != nil {
+		return "", err
+	}
+	if p.excerpt != nil {
+		return template.HTML(strings.TrimSpace(string(p.Excerpt()))), nil
+	}
+	if p.Summary != "" {
+		return template.HTML(template.HTMLEscapeString(p.Summary)), nil
+	}
+	m := firstParagraphRe.FindSubmatch(preBlockRe.ReplaceAll(p.html, nil))
+	if m == nil {
+		return "", nil
+	}
+	return template.HTML(bytes.TrimSpace(m[1])), nil
+}
+
+// Pager is a page of a paginated listing, returned by the paginate template
+// function.
+type Pager struct {
+	Pages  []*Page // pages on this page
+	Number int     // number of this page, starting from 1
+	Total  int     // total number of pages
+	Prev   string  // URL of the previous page, if any
+	Next   string  // URL of the next page, if any
+}
+
+// paginate splits pages into groups of size and returns the group for the
+// current page of p, e.g. {{ $pager := paginate . (pages "post") 10 }}. The
+// first page is built at the permalink of p, others at <permalink>/page/<n>.
+func (b *buildContext) paginate(p *Page, pages []*Page, size int) (*Pager, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid page size %d: must be positive", size)
+	}
+	total := max((len(pages)+size-1)/size, 1)
+	p.pageCount = max(p.pageCount, total)
+	num := max(p.pageNum, 1)
+	base := cmp.Or(p.basePerm, p.Permalink)
+
+	pg := &Pager{Number: num, Total: total}
+	if start := (num - 1) * size; start < len(pages) {
+		pg.Pages = pages[start:min(start+size, len(pages))]
+	}
+	if num > 1 {
+		pg.Prev = b.url(pagePermalink(base, num-1))
+	}
+	if num < total {
+		pg.Next = b.url(pagePermalink(base, num+1))
+	}
+	return pg, nil
+}
+
+// pagePermalink returns the permalink of page num of a listing at base.
+func pagePermalink(base string, num int) string {
+	if num == 1 {
+		return base
+	}
+	return path.Join(base, "page", strconv.Itoa(num))
+}
+
+// writePaginated builds and writes pages after the first of a listing p, if it
+// was paginated.
+func (b *buildContext) writePaginated(p *Page) error {
+	for num := 2; num <= p.pageCount; num++ {
+		pp := *p
+		pp.pageNum = num
+		pp.basePerm = p.Permalink
+		pp.Permalink = pagePermalink(p.Permalink, num)
+		pp.dstPath = dstPath(pp.Permalink)
+		pp.html, pp.excerpt = nil, nil
+		pp.rendered = false
+		if err := b.writePage(&pp, b.c.Dst); err != nil {
+			if err := b.pageFailed(&pp, b.c.Dst, err); err != nil {
+				return err
+			}
+			continue
+		}
+		b.paginated = append(b.paginated, &pp)
+	}
+	return nil
+}
+
+// renderPage returns the rendered contents of a page with the permalink.
+func (b *buildContext) renderPage(permalink string) (template.HTML, error) {
+	for _, p := range b.pages {
+		if p.Permalink != permalink {
+			continue
+		}
+		if err := p.render(b); err != nil {
+			return "", err
+		}
+		return template.HTML(p.html), nil
+	}
+	return "", fmt.Errorf("no page with permalink %q", permalink)
+}
+
+// hasPage reports whether a page with the permalink is built.
+func (b *buildContext) hasPage(permalink string) bool {
+	for _, p := range slices.Concat(b.pages, b.tagPages) {
+		if p.Permalink == permalink {
+			return true
+		}
+	}
+	return false
 }
 
 func (b *buildContext) pagesByType(typ string) []*Page {
-	if typ == "" {
-		return b.pages
-	}
 	var pages []*Page
 	for _, p := range b.pages {
-		if p.Type == typ {
+		if p.RedirectTo != "" {
+			continue
+		}
+		if typ == "" || p.Type == typ {
 			pages = append(pages, p)
 		}
 	}
@@ -544,14 +2925,56 @@ func isFullURL(url string) bool {
 }
 
 func (b *buildContext) url(base string) string {
-	if isFullURL(base) || !b.c.Prod || b.c.BaseURL == nil {
+	if !b.c.Prod || b.c.BaseURL == nil {
 		return base
 	}
+	return b.absURL(base)
+}
+
+// absURL resolves the root-relative link against BaseURL, keeping a trailing
+// slash. Full URLs are returned as is.
+func (b *buildContext) absURL(link string) string {
+	if isFullURL(link) {
+		return link
+	}
 	u := *b.c.BaseURL
-	u.Path = path.Join(u.Path, base)
+	u.Path = path.Join(u.Path, link)
+	if strings.HasSuffix(link, "/") && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
 	return u.String()
 }
 
+var rootRelLinkRe = regexp.MustCompile(`\b(href|src)="(/[^"]*)"`)
+
+// absolutizeLinks rewrites root-relative links in HTML to absolute ones when
+// enabled by AbsolutizeLinks.
+func (b *buildContext) absolutizeLinks(html []byte) []byte {
+	if !b.c.Prod || !b.c.AbsolutizeLinks || b.c.BaseURL == nil {
+		return html
+	}
+	return rootRelLinkRe.ReplaceAllFunc(html, func(match []byte) []byte {
+		sm := rootRelLinkRe.FindSubmatch(match)
+		attr, link := sm[1], string(sm[2])
+		// Protocol-relative URL.
+		if strings.HasPrefix(link, "//") {
+			return match
+		}
+		ref, err := url.Parse(link)
+		if err != nil {
+			return match
+		}
+		abs := b.absURL(ref.Path)
+		if ref.RawQuery != "" {
+			abs += "?" + ref.RawQuery
+		}
+		if ref.Fragment != "" {
+			abs += "#" + ref.EscapedFragment()
+		}
+		return []byte(fmt.Sprintf(`%s="%s"`, attr, abs))
+	})
+}
+
 func (b *buildContext) vanityURL(base string) string {
 	if isFullURL(base) {
 		return base
@@ -590,10 +3013,60 @@ func (b *buildContext) parseTemplates(path string, d fs.DirEntry, err error) err
 	if err != nil {
 		return err
 	}
+	for _, t := range b.templates[name].Templates() {
+		if t.Tree != nil && callsFunc(t.Tree.Root, "toc") {
+			b.usesTOC = true
+		}
+	}
 
 	return nil
 }
 
+// callsFunc reports whether the template node calls the function name.
+func callsFunc(node parse.Node, name string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, n := range n.Nodes {
+			if callsFunc(n, name) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return callsFunc(n.Pipe, name)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if callsFunc(cmd, name) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if callsFunc(arg, name) {
+				return true
+			}
+		}
+	case *parse.IdentifierNode:
+		return n.Ident == name
+	case *parse.IfNode:
+		return callsFunc(&n.BranchNode, name)
+	case *parse.RangeNode:
+		return callsFunc(&n.BranchNode, name)
+	case *parse.WithNode:
+		return callsFunc(&n.BranchNode, name)
+	case *parse.BranchNode:
+		return callsFunc(n.Pipe, name) || callsFunc(n.List, name) || callsFunc(n.ElseList, name)
+	case *parse.TemplateNode:
+		return callsFunc(n.Pipe, name)
+	}
+	return false
+}
+
 func (b *buildContext) parsePages(path string, d fs.DirEntry, err error) error {
 	if err != nil {
 		return err
@@ -619,42 +3092,132 @@ func (b *buildContext) parsePages(path string, d fs.DirEntry, err error) error {
 	}
 	defer f.Close()
 
-	p := &Page{path: path}
+	p := &Page{path: path, b: b}
 	if err := p.parse(f); err != nil {
 		return err
 	}
-	if !p.Draft || !b.c.Prod {
+	switch {
+	case !b.unpublished(p) || !b.c.Prod:
 		b.pages = append(b.pages, p)
+	case b.c.DraftsDst != "":
+		b.drafts = append(b.drafts, p)
 	}
 
 	return nil
 }
 
+// unpublished reports whether p is a draft or is scheduled, i.e. dated in the
+// future, so it's held back from production builds.
+func (b *buildContext) unpublished(p *Page) bool {
+	return p.Draft || (p.Date != nil && p.Date.After(b.now))
+}
+
 // Page represents a site page. The exported fields is the front matter fields.
 type Page struct {
-	Title       string            `json:"title"`                  // title: Page title, required.
-	Permalink   string            `json:"permalink"`              // permalink: Output path for the page, required.
-	Template    string            `json:"template"`               // template: Template that should be used for rendering this page, required.
-	ContentOnly bool              `json:"content_only,omitempty"` // content_only: Determines whether this page should be rendered without header and footer, false by default.
-	Date        *date             `json:"date,omitempty"`         // date: Publication date in the 'year-month-day' format, e.g. 2006-01-02, optional.
-	Draft       bool              `json:"draft,omitempty"`        // draft: Determines whether this page should be not included in production builds, false by default.
-	MetaTags    map[string]string `json:"meta_tags,omitempty"`    // meta_tags: Determines additional HTML meta tags that will be added to this page, optional.
-	Summary     string            `json:"summary,omitempty"`      // summary: Page summary, used in RSS feed, optional.
-	Type        string            `json:"type,omitempty"`         // type: Used to distinguish different kinds of pages, page by default.
-	CSS         []string          `json:"css,omitempty"`          // css: Additional CSS files that should be loaded, optional.
-	JS          []string          `json:"js,omitempty"`           // js: Additional JavaScript files that should be loaded, optional.
-
-	path     string // path to the page source
-	dstPath  string // where to write the built page
-	contents []byte // page contents without front matter
+	Title           string            `json:"title"`                       // title: Page title, required.
+	Permalink       string            `json:"permalink"`                   // permalink: Output path for the page, required.
+	Template        string            `json:"template"`                    // template: Template that should be used for rendering this page, required.
+	ContentOnly     bool              `json:"content_only,omitempty"`      // content_only: Determines whether this page should be rendered without header and footer, false by default.
+	Date            *date             `json:"date,omitempty"`              // date: Publication date in the 'year-month-day' format, e.g. 2006-01-02, or in RFC 3339 format if Config.AllowDateTime is set, optional. Pages dated in the future are treated as drafts in production builds.
+	Draft           bool              `json:"draft,omitempty"`             // draft: Determines whether this page should be not included in production builds, false by default.
+	MetaTags        map[string]string `json:"meta_tags,omitempty"`         // meta_tags: Determines additional HTML meta tags that will be added to this page, optional.
+	Summary         string            `json:"summary,omitempty"`           // summary: Page summary, used in RSS feed, optional. Extracted from contents before the <!-- more --> marker by default.
+	Type            string            `json:"type,omitempty"`              // type: Used to distinguish different kinds of pages, page by default.
+	CSS             []string          `json:"css,omitempty"`               // css: Additional CSS files that should be loaded, optional.
+	JS              []Script          `json:"js,omitempty"`                // js: Additional JavaScript files that should be loaded, either paths or objects with src, module, defer and async keys, optional.
+	Preload         bool              `json:"preload,omitempty"`           // preload: Determines whether preload hints for css and js should be emitted, false by default.
+	HeadingIDPrefix string            `json:"heading_id_prefix,omitempty"` // heading_id_prefix: Prefix for heading IDs when Config.PrefixHeadingIDs is set, last element of permalink by default.
+	Tags            []string          `json:"tags,omitempty"`              // tags: Page tags, optional.
+	Image           string            `json:"image,omitempty"`             // image: Image used when sharing the page, e.g. in Open Graph tags, optional.
+	BodyClass       string            `json:"body_class,omitempty"`        // body_class: Overrides classes of the body element generated from type and tags, optional.
+	Output          string            `json:"output,omitempty"`            // output: Exact output path, e.g. /.well-known/security.txt, instead of one derived from permalink, optional.
+	Index           *bool             `json:"index,omitempty"`             // index: Determines whether this page should be included in the search index, true by default.
+	Math            bool              `json:"math,omitempty"`              // math: Determines whether $...$ and $$...$$ in Markdown are TeX math wrapped in elements with math class for client-side rendering, false by default.
+	RedirectTo      string            `json:"redirect_to,omitempty"`       // redirect_to: Permalink or URL this page has moved to, optional. Such pages are built as redirect stubs, don't need a template and are left out of feeds, listings and build results.
+
+	path     string            // path to the page source
+	dstPath  string            // where to write the built page
+	contents []byte            // page source without front matter, never modified after parsing
+	html     []byte            // rendered contents, see render
+	b        *buildContext     // build context the page belongs to, if any
+	ogImage  string            // path to the generated Open Graph image, if any
+	excerpt  []byte            // contents before the <!-- more --> marker, if any
+	srcSum   [sha256.Size]byte // hash of the page source, see reuseRender
+	failed   bool              // replaced with an error page, see Config.ContinueOnError
+
+	rendered, rendering bool // see render
+
+	pageNum   int    // number of the page of a paginated listing, see paginate
+	pageCount int    // total number of pages of a paginated listing, if paginated
+	basePerm  string // permalink of the first page of a paginated listing
+}
+
+// defaultWordsPerMinute is a reading speed used to estimate reading time,
+// unless overridden by Config.WordsPerMinute.
+const defaultWordsPerMinute = 200
+
+// URL returns the resolved permalink of the page.
+func (p *Page) URL() string {
+	if p.b == nil {
+		return p.Permalink
+	}
+	return p.b.url(p.Permalink)
+}
+
+// Excerpt returns the rendered contents before the <!-- more --> marker, or an
+// empty string if the page has no marker. See also the excerpt template
+// function, which falls back to the summary and the first paragraph.
+func (p *Page) Excerpt() template.HTML {
+	return template.HTML(p.excerpt)
+}
+
+// WordCount returns the number of words in the rendered page contents. It's 0
+// until the page is rendered, so use the wordCount template function to count
+// words of other pages.
+func (p *Page) WordCount() int {
+	return countWords(p.html)
+}
+
+// ReadingTime returns the estimated reading time of the page in minutes,
+// rounded up. Like WordCount, it's 0 until the page is rendered.
+func (p *Page) ReadingTime() int {
+	wpm := defaultWordsPerMinute
+	if p.b != nil && p.b.c.WordsPerMinute > 0 {
+		wpm = p.b.c.WordsPerMinute
+	}
+	return (p.WordCount() + wpm - 1) / wpm
 }
 
 type date struct {
 	time.Time
+	hasTime bool // set in RFC 3339 format, see Config.AllowDateTime
 }
 
 const dateLayout = "2006-01-02"
 
+// Script is a JavaScript file loaded by a page. In front matter it's either a
+// path or an object with src, module, defer and async keys.
+type Script struct {
+	Src    string `json:"src"`
+	Module bool   `json:"module,omitempty"` // load as ES module
+	Defer  bool   `json:"defer,omitempty"`
+	Async  bool   `json:"async,omitempty"`
+}
+
+func (s *Script) UnmarshalJSON(p []byte) error {
+	if err := json.Unmarshal(p, &s.Src); err == nil {
+		return nil
+	}
+	type script Script // avoid recursion
+	if err := json.Unmarshal(p, (*script)(s)); err != nil {
+		return err
+	}
+	if s.Src == "" {
+		return errors.New("script without src")
+	}
+	return nil
+}
+
 func (d *date) UnmarshalJSON(p []byte) error {
 	s := strings.Trim(string(p), "\"")
 	if s == "null" {
@@ -663,12 +3226,15 @@ func (d *date) UnmarshalJSON(p []byte) error {
 	}
 
 	dt, err := time.Parse(dateLayout, s)
-	if err != nil {
-		return err
+	if err == nil {
+		d.Time, d.hasTime = dt, false
+		return nil
 	}
-	d.Time = dt
-
-	return nil
+	if dt, err := time.Parse(time.RFC3339, s); err == nil {
+		d.Time, d.hasTime = dt, true
+		return nil
+	}
+	return fmt.Errorf("invalid date %q: want year-month-day format, e.g. 2006-01-02", s)
 }
 
 func (p *Page) parse(r io.Reader) error {
@@ -681,7 +3247,7 @@ func (p *Page) parse(r io.Reader) error {
 		}
 	}
 	if !supported {
-		return fmt.Errorf("%s: %w", p.path, errFormatUnsupported)
+		return &BuildError{Path: p.path, Phase: PhaseParse, Err: errFormatUnsupported}
 	}
 
 	const (
@@ -689,8 +3255,14 @@ func (p *Page) parse(r io.Reader) error {
 		rightDelim = "}\n"
 	)
 
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return &BuildError{Path: p.path, Phase: PhaseParse, Err: fmt.Errorf("%w: %v", errFrontmatterSplit, err)}
+	}
+	p.srcSum = sha256.Sum256(data)
+
 	// Split the front matter and contents.
-	scanner := bufio.NewScanner(r)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	var (
 		frontmatter, contents []byte
 		reachedFrontmatter    bool
@@ -722,16 +3294,28 @@ func (p *Page) parse(r io.Reader) error {
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("%s: %w: %v", p.path, errFrontmatterSplit, err)
-	}
-	if len(frontmatter) == 0 {
-		return fmt.Errorf("%s: %w", p.path, errFrontmatterMissing)
+		return &BuildError{Path: p.path, Phase: PhaseParse, Err: fmt.Errorf("%w: %v", errFrontmatterSplit, err)}
+	}
+	switch {
+	case len(frontmatter) > 0:
+		p.contents = contents
+		// Parse the front matter.
+		dec := json.NewDecoder(bytes.NewReader(frontmatter))
+		if p.b != nil && p.b.c.StrictFrontMatter {
+			dec.DisallowUnknownFields()
+		}
+		if err := dec.Decode(p); err != nil {
+			return &BuildError{Path: p.path, Phase: PhaseParse, Err: fmt.Errorf("%w: %v", errFrontmatterParse, err)}
+		}
+	case p.b != nil && p.b.c.InferFrontmatter && filepath.Ext(p.path) == ".md":
+		if err := p.inferFrontmatter(data); err != nil {
+			return &BuildError{Path: p.path, Phase: PhaseParse, Err: err}
+		}
+	default:
+		return &BuildError{Path: p.path, Phase: PhaseParse, Err: errFrontmatterMissing}
 	}
-	p.contents = contents
-
-	// Parse the front matter.
-	if err := json.Unmarshal(frontmatter, p); err != nil {
-		return fmt.Errorf("%s: %w: %v", p.path, errFrontmatterParse, err)
+	if p.Date != nil && p.Date.hasTime && (p.b == nil || !p.b.c.AllowDateTime) {
+		return &BuildError{Path: p.path, Phase: PhaseParse, Err: fmt.Errorf("%w: date %q has time, but Config.AllowDateTime is not set; want year-month-day format, e.g. 2006-01-02", errFrontmatterParse, p.Date.Format(time.RFC3339))}
 	}
 	// Set the default page type.
 	if p.Type == "" {
@@ -739,59 +3323,451 @@ func (p *Page) parse(r io.Reader) error {
 	}
 
 	// Check front matter fields.
-	if p.Title == "" || p.Template == "" || p.Permalink == "" {
-		return fmt.Errorf("%s: %w", p.path, errFrontmatterMissingParam)
+	if p.Title == "" || (p.Template == "" && p.RedirectTo == "") || p.Permalink == "" {
+		return &BuildError{Path: p.path, Phase: PhaseParse, Err: errFrontmatterMissingParam}
 	}
 	if _, err := url.ParseRequestURI(p.Permalink); err != nil {
-		return fmt.Errorf("%s: %w: %v", p.path, errPermalinkInvalid, err)
+		return &BuildError{Path: p.path, Phase: PhaseParse, Err: fmt.Errorf("%w: %v", errPermalinkInvalid, err)}
+	}
+	if p.Output != "" {
+		out := path.Clean(strings.TrimPrefix(p.Output, "/"))
+		if out == "." || out == ".." || strings.HasPrefix(out, "../") {
+			return &BuildError{Path: p.path, Phase: PhaseParse, Err: fmt.Errorf("%w %q: must be inside the build directory", errOutputInvalid, p.Output)}
+		}
+		p.dstPath = "/" + out
+		return nil
 	}
-	p.dstPath = p.Permalink
-	if !strings.HasSuffix(p.dstPath, ".html") {
-		if p.dstPath == "/" {
-			p.dstPath = p.dstPath + "index"
+	p.dstPath = dstPath(p.Permalink)
+
+	return nil
+}
+
+// dstPath returns where to write a page with permalink.
+func dstPath(permalink string) string {
+	dst := permalink
+	if !strings.HasSuffix(dst, ".html") {
+		if dst == "/" {
+			dst = dst + "index"
 		}
-		p.dstPath = p.dstPath + ".html"
+		dst = dst + ".html"
 	}
-	p.dstPath = path.Clean(p.dstPath)
+	return path.Clean(dst)
+}
+
+var leadingHeadingRe = regexp.MustCompile(`\A\s*# +(.+?)\s*(?:\n|\z)`)
+
+// inferFrontmatter sets front matter fields of a Markdown page without front
+// matter from data, see Config.InferFrontmatter: title from the leading
+// heading, which is removed from the contents, and permalink from the path.
+func (p *Page) inferFrontmatter(data []byte) error {
+	m := leadingHeadingRe.FindSubmatchIndex(data)
+	if m == nil {
+		return fmt.Errorf("%w: no leading heading to infer title from", errFrontmatterMissing)
+	}
+	// Strip Markdown formatting from the title.
+	p.Title = plainText([]byte(markdown.ToHTML(p.b.md.Parse(string(data[m[2]:m[3]])))))
+	p.contents = data[m[1]:]
 
+	rel, err := filepath.Rel(filepath.Join(p.b.c.Src, "pages"), p.path)
+	if err != nil {
+		return err
+	}
+	permalink := "/" + strings.TrimSuffix(filepath.ToSlash(rel), filepath.Ext(rel))
+	if permalink == "/index" {
+		permalink = "/"
+	} else {
+		permalink = strings.TrimSuffix(permalink, "/index")
+	}
+	p.Permalink = permalink
+	p.Template = p.b.c.DefaultTemplate
 	return nil
 }
 
+var (
+	draftFieldRe = regexp.MustCompile(`^(\s*"draft"\s*:\s*)true`)
+	dateFieldRe  = regexp.MustCompile(`^(\s*"date"\s*:\s*)("[^"]*"|null)`)
+	indentRe     = regexp.MustCompile(`^\s*`)
+)
+
+// Publish publishes a draft page located at path: it sets the draft front
+// matter field to false and the date field to the date of now.
+//
+// Only the front matter is rewritten, the page contents are left byte-for-byte
+// intact.
+func Publish(path string, now time.Time) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Parse the page like Build does. The site configuration isn't known
+	// here, so accept dates with time too: they're replaced anyway.
+	bc := newBuildContext(&Config{AllowDateTime: true})
+	p := &Page{path: path, b: bc}
+	if err := p.parse(bytes.NewReader(b)); err != nil {
+		return err
+	}
+	if !p.Draft {
+		return fmt.Errorf("%s: %w", path, errNotDraft)
+	}
+
+	lines := bytes.SplitAfter(b, []byte("\n"))
+
+	// Find the front matter boundaries, the same way as Page.parse does.
+	start, end := -1, -1
+	for i, line := range lines {
+		if start == -1 && string(line) == "{\n" {
+			start = i
+			continue
+		}
+		if start != -1 && string(line) == "}\n" {
+			end = i
+			break
+		}
+	}
+	if start == -1 || end == -1 {
+		return fmt.Errorf("%s: %w", path, errFrontmatterMissing)
+	}
+
+	pubDate := []byte(`${1}"` + now.Format(dateLayout) + `"`)
+	var haveDate bool
+	for i := start + 1; i < end; i++ {
+		lines[i] = draftFieldRe.ReplaceAll(lines[i], []byte("${1}false"))
+		if dateFieldRe.Match(lines[i]) {
+			lines[i] = dateFieldRe.ReplaceAll(lines[i], pubDate)
+			haveDate = true
+		}
+	}
+
+	var buf bytes.Buffer
+	for i, line := range lines {
+		buf.Write(line)
+		if i == start && !haveDate {
+			// Add date as the first field, using the indentation of the field
+			// that follows it.
+			indent := indentRe.Find(lines[start+1])
+			fmt.Fprintf(&buf, "%s\"date\": %q,\n", indent, now.Format(dateLayout))
+		}
+	}
+
+	// Make sure that we produced a valid page.
+	np := &Page{path: path, b: bc}
+	if err := np.parse(bytes.NewReader(buf.Bytes())); err != nil {
+		return err
+	}
+	if np.Draft || np.Date == nil {
+		return fmt.Errorf("%s: failed to update front matter", path)
+	}
+
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
 var htmlCommentRe = regexp.MustCompile("<!--(.*?)-->")
 
+var (
+	imgTagRe       = regexp.MustCompile(`<img\b[^>]*>`)
+	eagerTitleRe   = regexp.MustCompile(`\s+title="eager"`)
+	loadingAttrRe  = regexp.MustCompile(`\sloading=`)
+	decodingAttrRe = regexp.MustCompile(`\sdecoding=`)
+)
+
+// lazyImages adds loading="lazy" and decoding="async" attributes to img tags
+// in doc that don't have them. Images with "eager" title, e.g.
+// ![Alt](/image.png "eager") in Markdown, are left alone, only the title is
+// removed.
+func lazyImages(doc []byte) []byte {
+	return imgTagRe.ReplaceAllFunc(doc, func(tag []byte) []byte {
+		if eagerTitleRe.Match(tag) {
+			return eagerTitleRe.ReplaceAll(tag, nil)
+		}
+		var attrs string
+		if !loadingAttrRe.Match(tag) {
+			attrs += ` loading="lazy"`
+		}
+		if !decodingAttrRe.Match(tag) {
+			attrs += ` decoding="async"`
+		}
+		if attrs == "" {
+			return tag
+		}
+		// Insert right after "<img".
+		return append([]byte("<img"+attrs), tag[len("<img"):]...)
+	})
+}
+
+// moreMarker separates an excerpt from the rest of the page contents.
+var moreMarker = []byte("<!-- more -->")
+
+var (
+	headingIDRe   = regexp.MustCompile(`(<h[1-6]\b[^>]*\bid=")([^"]+)"`)
+	fragmentRefRe = regexp.MustCompile(`\bhref="#([^"]+)"`)
+)
+
+func (p *Page) headingIDPrefix() string {
+	if p.HeadingIDPrefix != "" {
+		return p.HeadingIDPrefix
+	}
+	if p.Permalink == "/" {
+		return "index"
+	}
+	return path.Base(strings.TrimSuffix(p.Permalink, ".html"))
+}
+
+// prefixHeadingIDs prepends prefix to IDs of all headings in doc and rewrites
+// fragment links pointing to them.
+func prefixHeadingIDs(doc []byte, prefix string) []byte {
+	ids := make(map[string]bool)
+	doc = headingIDRe.ReplaceAllFunc(doc, func(match []byte) []byte {
+		sm := headingIDRe.FindSubmatch(match)
+		ids[string(sm[2])] = true
+		return []byte(fmt.Sprintf(`%s%s-%s"`, sm[1], prefix, sm[2]))
+	})
+	return fragmentRefRe.ReplaceAllFunc(doc, func(match []byte) []byte {
+		id := string(fragmentRefRe.FindSubmatch(match)[1])
+		if !ids[id] {
+			return match
+		}
+		return []byte(fmt.Sprintf(`href="#%s-%s"`, prefix, id))
+	})
+}
+
 func (p *Page) build(b *buildContext, tpl *template.Template, w io.Writer) error {
+	if err := p.render(b); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, p); err != nil {
+		return &BuildError{Path: p.path, Phase: PhaseRender, Err: fmt.Errorf("failed to execute template %q: %w", p.Template, err)}
+	}
+	if n := len(bytes.TrimSpace(buf.Bytes())); n == 0 || n < b.c.MinPageSize {
+		b.warnf("%s: template %q produced suspiciously small output (%d bytes)", p.path, p.Template, n)
+	}
+
+	out := b.absolutizeLinks(buf.Bytes())
+	if err := b.checkHead(p, out); err != nil {
+		return err
+	}
+
+	_, err := w.Write(out)
+	return err
+}
+
+var (
+	charsetMetaRe  = regexp.MustCompile(`(?i)<meta\s[^>]*\bcharset=`)
+	viewportMetaRe = regexp.MustCompile(`(?i)<meta\s[^>]*\bname="?viewport\b`)
+)
+
+// checkHead checks that the built page declares a charset and a viewport, if
+// enabled by CheckHead.
+func (b *buildContext) checkHead(p *Page, doc []byte) error {
+	if b.c.CheckHead == "" {
+		return nil
+	}
+	var missing []string
+	if !charsetMetaRe.Match(doc) {
+		missing = append(missing, "charset")
+	}
+	if !viewportMetaRe.Match(doc) {
+		missing = append(missing, "viewport")
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("missing %s meta tag", strings.Join(missing, " and "))
+	if b.c.CheckHead == "strict" {
+		return &BuildError{Path: p.path, Phase: PhaseRender, Err: errors.New(msg)}
+	}
+	b.warnf("%s: %s", p.path, msg)
+	return nil
+}
+
+// render renders the page contents to HTML, executing them as a template and
+// converting from Markdown, if needed.
+func (p *Page) render(b *buildContext) error {
+	// Pages can be rendered early when embedded with renderPage.
+	if p.rendered {
+		return nil
+	}
+	if p.rendering {
+		return &BuildError{Path: p.path, Phase: PhaseRender, Err: errors.New("page embeds itself")}
+	}
+	p.rendering = true
+	defer func() { p.rendering = false }()
+
 	// We use here text/template, but not html/template because we don't want to
 	// escape any HTML on the Markdown source.
 	ptpl, err := ttemplate.New(p.path).Funcs(ttemplate.FuncMap(b.funcs)).Parse(string(p.contents))
 	if err != nil {
-		return err
+		return &BuildError{Path: p.path, Phase: PhaseRender, Err: err}
 	}
 	var pbuf bytes.Buffer
 	if err = ptpl.Execute(&pbuf, p); err != nil {
-		return fmt.Errorf("%s: failed to execute page template: %w", p.path, err)
+		return &BuildError{Path: p.path, Phase: PhaseRender, Err: fmt.Errorf("failed to execute page template: %w", err)}
 	}
-	p.contents = pbuf.Bytes()
+	out := pbuf.Bytes()
 
 	if filepath.Ext(p.path) == ".md" {
-		doc := b.md.Parse(string(p.contents))
-		p.contents = []byte(markdown.ToHTML(doc))
+		src := string(out)
+		var math []mathSpan
+		if p.Math {
+			src, math = extractMath(src)
+		}
+		doc := b.md.Parse(src)
+		if b.autoHeadingIDs() {
+			addHeadingIDs(doc)
+		}
+		out = addHeadingAnchors([]byte(markdown.ToHTML(doc)))
+		if len(math) > 0 {
+			out = insertMath(out, math)
+		}
+	}
+
+	if before, after, ok := bytes.Cut(out, moreMarker); ok {
+		p.excerpt = htmlCommentRe.ReplaceAll(before, []byte{})
+		if p.Summary == "" {
+			p.Summary = plainText(p.excerpt)
+		}
+		out = append(before[:len(before):len(before)], after...)
+	}
+	out = htmlCommentRe.ReplaceAll(out, []byte{})
+	if len(b.c.Emoji) > 0 {
+		out = b.expandEmoji(out)
+	}
+	if b.c.LazyImages {
+		out = lazyImages(out)
 	}
+	if b.c.PrefixHeadingIDs {
+		out = prefixHeadingIDs(out, p.headingIDPrefix())
+	}
+	p.html = b.absolutizeLinks(out)
+	p.rendered = true
+	b.recordRender(p)
 
-	p.contents = htmlCommentRe.ReplaceAll(p.contents, []byte{})
+	return nil
+}
 
-	var buf bytes.Buffer
-	if err := tpl.Execute(&buf, p); err != nil {
-		return fmt.Errorf("%s: failed to execute template %q: %w", p.path, p.Template, err)
+// reusable reports whether rendered contents of p depend only on its source.
+// Template actions in contents can use other pages and templates, so pages
+// with them are always rendered again.
+func (p *Page) reusable() bool {
+	return !bytes.Contains(p.contents, []byte("{{"))
+}
+
+// reuseRender sets rendered contents of p from the previous build, if its
+// source didn't change, and reports whether it did.
+func (b *buildContext) reuseRender(p *Page) bool {
+	if b.state == nil || p.rendered || !p.reusable() {
+		return false
 	}
+	r, ok := b.state.renders[p.path]
+	if !ok || r.sum != p.srcSum || r.headingIDs != b.autoHeadingIDs() {
+		return false
+	}
+	p.html, p.excerpt, p.rendered = r.html, r.excerpt, true
+	if p.Summary == "" {
+		p.Summary = r.summary
+	}
+	b.writtenMu.Lock()
+	b.renders[p.path] = r
+	b.writtenMu.Unlock()
+	return true
+}
 
-	_, err = buf.WriteTo(w)
-	return err
+// recordRender records that p was rendered by an incremental build, so the
+// next one can reuse the result.
+func (b *buildContext) recordRender(p *Page) {
+	if b.state == nil {
+		return
+	}
+	b.writtenMu.Lock()
+	defer b.writtenMu.Unlock()
+	b.renderedPaths = append(b.renderedPaths, p.path)
+	if p.reusable() {
+		b.renders[p.path] = &renderedPage{
+			sum:        p.srcSum,
+			headingIDs: b.autoHeadingIDs(),
+			html:       p.html,
+			excerpt:    p.excerpt,
+			summary:    p.Summary,
+		}
+	}
 }
 
 func (b *buildContext) buildFeed() error {
+	isPost := func(p *Page) bool { return p.Type == "post" }
+	feed := b.newFeed(b.c.Title, "/", isPost)
+	if err := b.writeFeed("feed.xml", b.c.FeedSelfURL, feed); err != nil {
+		return err
+	}
+	if err := b.writeJSONFeed("feed.json", feed); err != nil {
+		return err
+	}
+	if err := b.writeRSSFeed("rss.xml", feed); err != nil {
+		return err
+	}
+
+	for _, cf := range b.categoryFeeds() {
+		if err := b.writeFeed(categoryFeedPath(cf.listing), "", b.newFeed(b.c.Title+": "+cf.name, cf.listing, cf.include)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// categoryFeed is a feed of pages of a type or with a tag, see
+// [Config.CategoryFeeds] and [Config.TagFeeds].
+type categoryFeed struct {
+	name    string // page type or tag
+	listing string // path of the listing page
+	include func(*Page) bool
+}
+
+// categoryFeeds returns category and tag feeds, sorted by listing path.
+func (b *buildContext) categoryFeeds() []categoryFeed {
+	var cfs []categoryFeed
+	for typ, listing := range b.c.CategoryFeeds {
+		cfs = append(cfs, categoryFeed{
+			name:    typ,
+			listing: listing,
+			include: func(p *Page) bool { return p.Type == typ },
+		})
+	}
+	for tag, listing := range b.c.TagFeeds {
+		cfs = append(cfs, categoryFeed{
+			name:    tag,
+			listing: listing,
+			include: func(p *Page) bool { return p.Type == "post" && slices.Contains(p.Tags, tag) },
+		})
+	}
+	slices.SortFunc(cfs, func(a, b categoryFeed) int { return strings.Compare(a.listing, b.listing) })
+	return cfs
+}
+
+// categoryFeedPath returns the path of the feed advertised on the listing
+// page.
+func categoryFeedPath(listing string) string {
+	return path.Join(strings.TrimPrefix(listing, "/"), "feed.xml")
+}
+
+// atomFeed is an Atom feed that, unlike [feeds.AtomFeed], can have more than
+// one link.
+type atomFeed struct {
+	*feeds.AtomFeed
+	Links   []*feeds.AtomLink  `xml:"link"`
+	Author  *feeds.AtomAuthor  `xml:"author,omitempty"`
+	Entries []*feeds.AtomEntry `xml:"entry"`
+}
+
+func (f *atomFeed) FeedXml() any { return f }
+
+// newFeed returns a feed that contains pages for which include returns true.
+// link is a path of the page that the feed represents.
+func (b *buildContext) newFeed(title, link string, include func(*Page) bool) *feeds.Feed {
 	feed := &feeds.Feed{
-		Title:   b.c.Title,
-		Link:    &feeds.Link{Href: b.c.BaseURL.String() + "/"},
+		Title:   title,
+		Link:    &feeds.Link{Href: b.absURL(link)},
 		Author:  &feeds.Author{Name: b.c.Author},
 		Created: time.Now(),
 	}
@@ -801,7 +3777,7 @@ func (b *buildContext) buildFeed() error {
 	}
 
 	for _, p := range b.pages {
-		if p.Type != "post" {
+		if p.failed || p.RedirectTo != "" || !include(p) {
 			continue
 		}
 
@@ -809,25 +3785,117 @@ func (b *buildContext) buildFeed() error {
 			continue
 		}
 
-		pu := *b.c.BaseURL
-		pu.Path = path.Join(pu.Path, p.Permalink)
-
 		item := &feeds.Item{
 			Title:       p.Title,
-			Link:        &feeds.Link{Href: pu.String()},
+			Link:        &feeds.Link{Href: b.absURL(p.Permalink)},
 			Author:      feed.Author,
 			Description: p.Summary,
-			Content:     string(p.contents),
+			Content:     string(p.html),
 		}
 		if p.Date != nil {
 			item.Created = p.Date.Time
 		}
 		feed.Items = append(feed.Items, item)
 	}
+	return feed
+}
+
+// writeFeed writes feed in Atom format to dst (relative to Dst). If self is
+// empty, the feed's self URL is derived from dst.
+func (b *buildContext) writeFeed(dst, self string, feed *feeds.Feed) error {
+	af := (&feeds.Atom{Feed: feed}).AtomFeed()
+	if self == "" {
+		self = b.absURL(dst)
+	} else {
+		af.Id = self
+	}
+	bf, err := feeds.ToXML(&atomFeed{
+		AtomFeed: af,
+		Links:    []*feeds.AtomLink{af.Link, {Href: self, Rel: "self"}},
+		Author:   af.Author,
+		Entries:  af.Entries,
+	})
+	if err != nil {
+		return err
+	}
+	return b.writeFile(b.c.Dst, dst, b.finalNewline([]byte(bf)))
+}
+
+// searchIndexEntry is a page in search-index.json, see Config.SearchIndex.
+type searchIndexEntry struct {
+	Title     string `json:"title"`
+	Permalink string `json:"permalink"`
+	Summary   string `json:"summary,omitempty"`
+	Content   string `json:"content"`
+}
+
+// writeSearchIndex writes search-index.json to Dst.
+func (b *buildContext) writeSearchIndex() error {
+	entries := []searchIndexEntry{}
+	for _, p := range b.pages {
+		if p.failed || b.unpublished(p) || p.RedirectTo != "" || (p.Index != nil && !*p.Index) {
+			continue
+		}
+		entries = append(entries, searchIndexEntry{
+			Title:     p.Title,
+			Permalink: p.Permalink,
+			Summary:   p.Summary,
+			Content:   plainText(p.html),
+		})
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return b.writeFile(b.c.Dst, "search-index.json", b.finalNewline(data))
+}
+
+// writeRSSFeed writes feed in RSS 2.0 format to dst (relative to Dst), for
+// aggregators that don't handle Atom well.
+func (b *buildContext) writeRSSFeed(dst string, feed *feeds.Feed) error {
+	rf := (&feeds.Rss{Feed: feed}).RssFeed()
+	// The library formats the author as "email (name)", but we have no email.
+	rf.ManagingEditor = feed.Author.Name
+	bf, err := feeds.ToXML(rf)
+	if err != nil {
+		return err
+	}
+	return b.writeFile(b.c.Dst, dst, b.finalNewline([]byte(bf)))
+}
 
-	bf, err := feed.ToAtom()
+// writeJSONFeed writes feed in JSON Feed format to dst (relative to Dst).
+func (b *buildContext) writeJSONFeed(dst string, feed *feeds.Feed) error {
+	jf := (&feeds.JSON{Feed: feed}).JSONFeed()
+	jf.FeedUrl = b.absURL(dst)
+	// JSON Feed requires item IDs. Use URLs, since they are unique and stable.
+	for _, item := range jf.Items {
+		if item.Id == "" {
+			item.Id = item.Url
+		}
+	}
+	bf, err := jf.ToJSON()
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join(b.c.Dst, "feed.xml"), []byte(bf), 0o644)
+	return b.writeFile(b.c.Dst, dst, b.finalNewline([]byte(bf)))
+}
+
+// feedLinks returns feed discovery links for p: the site-wide feed and, if p
+// is a listing page of a category or tag feed, that feed.
+func (b *buildContext) feedLinks(p *Page) template.HTML {
+	if b.c.SkipFeed {
+		return ""
+	}
+	const tmpl = `<link rel="alternate" type="application/atom+xml" title="%s" href="%s" />`
+	links := []string{
+		fmt.Sprintf(tmpl, template.HTMLEscapeString(b.c.Title), b.url("/feed.xml")),
+		fmt.Sprintf(`<link rel="alternate" type="application/rss+xml" title="%s" href="%s" />`, template.HTMLEscapeString(b.c.Title), b.url("/rss.xml")),
+		fmt.Sprintf(`<link rel="alternate" type="application/feed+json" title="%s" href="%s" />`, template.HTMLEscapeString(b.c.Title), b.url("/feed.json")),
+	}
+	for _, cf := range b.categoryFeeds() {
+		if p.Permalink == cf.listing {
+			links = append(links, fmt.Sprintf(tmpl, template.HTMLEscapeString(b.c.Title+": "+cf.name), b.url("/"+categoryFeedPath(cf.listing))))
+		}
+	}
+	return template.HTML(strings.Join(links, "\n"))
 }
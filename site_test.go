@@ -5,20 +5,36 @@
 package site
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"html/template"
+	"io"
+	"io/fs"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/fsnotify/fsnotify"
 	"go.astrophena.name/base/testutil"
 	"go.astrophena.name/base/txtar"
@@ -49,7 +65,93 @@ func TestBuild(t *testing.T) {
 	}, *update)
 }
 
+// TestBuildProd builds the real site in production mode, so breakages that
+// only show up in production builds are caught before deploy.
+func TestBuildProd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping production build in short mode")
+	}
+
+	dst := t.TempDir()
+	if err := Build(&Config{
+		Src:  ".",
+		Dst:  dst,
+		Logf: t.Logf,
+		Prod: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{"index.html", "404.html", "feed.xml", "feed.json", "rss.xml"} {
+		if _, err := os.Stat(filepath.Join(dst, f)); err != nil {
+			t.Errorf("production build: %v", err)
+		}
+	}
+}
+
 func TestServe(t *testing.T) {
+	addr := startServer(t, &Config{
+		Dst:  t.TempDir(),
+		Logf: t.Logf,
+	})
+
+	// Make some HTTP requests.
+	urls := []struct {
+		url        string
+		wantStatus int
+	}{
+		{url: "/", wantStatus: http.StatusOK},
+		{url: "/watched", wantStatus: http.StatusOK},
+		{url: "/404", wantStatus: http.StatusOK},
+		{url: "/does-not-exist", wantStatus: http.StatusNotFound},
+		{url: "/icons/", wantStatus: http.StatusNotFound},
+	}
+
+	for _, u := range urls {
+		req, err := http.Get("http://" + addr + u.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.StatusCode != u.wantStatus {
+			t.Fatalf("GET %s: want status code %d, got %d", u.url, u.wantStatus, req.StatusCode)
+		}
+	}
+}
+
+func TestServeDir(t *testing.T) {
+	dst, serveDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(serveDir, "index.html"), []byte("from serve dir"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startServer(t, &Config{
+		Dst:      dst,
+		ServeDir: serveDir,
+		Logf:     t.Logf,
+	})
+
+	res, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertEqual(t, string(b), "from serve dir")
+
+	// Build still targets Dst.
+	if _, err := os.Stat(filepath.Join(dst, "index.html")); err != nil {
+		t.Errorf("build to Dst: %v", err)
+	}
+}
+
+// startServer starts Serve with c on a free port, waits until it's ready and
+// returns its address. The server is shut down when the test finishes.
+func startServer(t *testing.T, c *Config) string {
+	t.Helper()
+
 	// Find a free port for us.
 	port, err := getFreePort()
 	if err != nil {
@@ -69,10 +171,7 @@ func TestServe(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := Serve(ctx, &Config{
-			Dst:  t.TempDir(),
-			Logf: t.Logf,
-		}, addr); err != nil {
+		if err := Serve(ctx, c, addr); err != nil {
 			errCh <- err
 		}
 	}()
@@ -84,38 +183,21 @@ func TestServe(t *testing.T) {
 	case <-ready:
 	}
 
-	// Make some HTTP requests.
-	urls := []struct {
-		url        string
-		wantStatus int
-	}{
-		{url: "/", wantStatus: http.StatusOK},
-		{url: "/watched", wantStatus: http.StatusOK},
-		{url: "/404", wantStatus: http.StatusOK},
-		{url: "/does-not-exist", wantStatus: http.StatusNotFound},
-		{url: "/icons/", wantStatus: http.StatusNotFound},
-	}
-
-	for _, u := range urls {
-		req, err := http.Get("http://" + addr + u.url)
-		if err != nil {
-			t.Fatal(err)
+	t.Cleanup(func() {
+		// Try to gracefully shutdown the server.
+		cancel()
+		// Wait until the server shuts down.
+		wg.Wait()
+		serveReadyHook = nil
+		// See if the server failed to shutdown.
+		select {
+		case err := <-errCh:
+			t.Fatalf("Test server crashed during shutdown: %v", err)
+		default:
 		}
-		if req.StatusCode != u.wantStatus {
-			t.Fatalf("GET %s: want status code %d, got %d", u.url, u.wantStatus, req.StatusCode)
-		}
-	}
+	})
 
-	// Try to gracefully shutdown the server.
-	cancel()
-	// Wait until the server shuts down.
-	wg.Wait()
-	// See if the server failed to shutdown.
-	select {
-	case err := <-errCh:
-		t.Fatalf("Test server crashed during shutdown: %v", err)
-	default:
-	}
+	return addr
 }
 
 // getFreePort asks the kernel for a free open port that is ready to use.
@@ -161,6 +243,32 @@ func TestShouldRebuild(t *testing.T) {
 	}
 }
 
+func TestAbsURL(t *testing.T) {
+	cases := map[string]struct {
+		base string
+		link string
+		want string
+	}{
+		"root":              {base: "https://example.com", link: "/", want: "https://example.com/"},
+		"page":              {base: "https://example.com", link: "/blog", want: "https://example.com/blog"},
+		"relative to Dst":   {base: "https://example.com", link: "feed.xml", want: "https://example.com/feed.xml"},
+		"base with path":    {base: "https://example.com/site", link: "/blog", want: "https://example.com/site/blog"},
+		"trailing slash":    {base: "https://example.com/site", link: "/", want: "https://example.com/site/"},
+		"full URL":          {base: "https://example.com", link: "https://other.com/x", want: "https://other.com/x"},
+		"nested with slash": {base: "https://example.com/", link: "/a/b/", want: "https://example.com/a/b/"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			u, err := url.Parse(tc.base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := newBuildContext(&Config{BaseURL: u})
+			testutil.AssertEqual(t, b.absURL(tc.link), tc.want)
+		})
+	}
+}
+
 func TestStripComments(t *testing.T) {
 	b := newBuildContext(&Config{})
 	tpl := template.Must(template.New("test").Funcs(b.funcs).Parse(`{{ content . }}`))
@@ -403,8 +511,3543 @@ func TestNavLinkTemplateFunc(t *testing.T) {
 			b.c = tc.c
 			b.c.setDefaults()
 
-			got := b.navLink(tc.p, tc.title, tc.iconName, tc.path)
+			got, err := b.navLink(tc.p, tc.title, tc.iconName, tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
 			testutil.AssertEqual(t, string(got), tc.want)
 		})
 	}
 }
+
+func TestPublish(t *testing.T) {
+	const contents = `
+
+Some *draft* text.
+<!-- With a comment. -->
+`
+	cases := map[string]struct {
+		frontmatter string
+		want        string
+		wantErr     error
+	}{
+		"without date": {
+			frontmatter: `{
+  "title": "Hello",
+  "template": "layout",
+  "permalink": "/hello",
+  "draft": true
+}
+`,
+			want: `{
+  "date": "2024-03-10",
+  "title": "Hello",
+  "template": "layout",
+  "permalink": "/hello",
+  "draft": false
+}
+`,
+		},
+		"with date": {
+			frontmatter: `<!-- vim: set ft=markdown: -->
+{
+  "title": "Hello",
+  "template": "layout",
+  "permalink": "/hello",
+  "date": "2022-01-01",
+  "draft": true,
+  "type": "post"
+}
+`,
+			want: `<!-- vim: set ft=markdown: -->
+{
+  "title": "Hello",
+  "template": "layout",
+  "permalink": "/hello",
+  "date": "2024-03-10",
+  "draft": false,
+  "type": "post"
+}
+`,
+		},
+		"with date and time": {
+			frontmatter: `{
+  "title": "Hello",
+  "template": "layout",
+  "permalink": "/hello",
+  "date": "2022-01-01T10:00:00Z",
+  "draft": true
+}
+`,
+			want: `{
+  "title": "Hello",
+  "template": "layout",
+  "permalink": "/hello",
+  "date": "2024-03-10",
+  "draft": false
+}
+`,
+		},
+		"not a draft": {
+			frontmatter: `{
+  "title": "Hello",
+  "template": "layout",
+  "permalink": "/hello"
+}
+`,
+			wantErr: errNotDraft,
+		},
+	}
+
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hello.md")
+			if err := os.WriteFile(path, []byte(tc.frontmatter+contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := Publish(path, now)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("want error %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.AssertEqual(t, string(got), tc.want+contents)
+		})
+	}
+}
+
+// buildSite builds a site from txtar archive ar using c, filling in its Src,
+// Dst and Logf fields. It returns the directory with built site.
+func buildSite(t *testing.T, ar string, c *Config) string {
+	t.Helper()
+	c.Src, c.Dst = t.TempDir(), t.TempDir()
+	if c.Logf == nil {
+		c.Logf = t.Logf
+	}
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+	if err := Build(c); err != nil {
+		t.Fatal(err)
+	}
+	return c.Dst
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCategoryFeeds(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ feedLinks . }}
+{{ content . }}
+-- pages/notes.html --
+{
+  "title": "Notes",
+  "template": "layout",
+  "permalink": "/notes"
+}
+-- pages/blog.html --
+{
+  "title": "Blog",
+  "template": "layout",
+  "permalink": "/blog"
+}
+-- pages/go.html --
+{
+  "title": "Go",
+  "template": "layout",
+  "permalink": "/go"
+}
+-- pages/note.md --
+{
+  "title": "A note",
+  "template": "layout",
+  "type": "notes",
+  "permalink": "/notes/a-note",
+  "tags": ["go"]
+}
+
+A note.
+-- pages/post.md --
+{
+  "title": "A post",
+  "template": "layout",
+  "type": "post",
+  "permalink": "/blog/a-post",
+  "tags": ["go"]
+}
+
+A post.
+-- pages/other.md --
+{
+  "title": "Other post",
+  "template": "layout",
+  "type": "post",
+  "permalink": "/blog/other"
+}
+
+Other post.
+`
+	dst := buildSite(t, ar, &Config{
+		CategoryFeeds: map[string]string{"notes": "/notes", "post": "/blog"},
+		TagFeeds:      map[string]string{"go": "/go"},
+	})
+
+	cases := map[string]struct {
+		feed    string
+		listing string
+		want    []string
+		notWant []string
+	}{
+		"type": {
+			feed:    "notes/feed.xml",
+			listing: "notes.html",
+			want:    []string{"A note"},
+			notWant: []string{"A post", "Other post"},
+		},
+		"type with different listing path": {
+			feed:    "blog/feed.xml",
+			listing: "blog.html",
+			want:    []string{"A post", "Other post"},
+			notWant: []string{"A note"},
+		},
+		"tag": {
+			feed:    "go/feed.xml",
+			listing: "go.html",
+			want:    []string{"A post"},
+			notWant: []string{"A note", "Other post"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			feed := readFile(t, filepath.Join(dst, filepath.FromSlash(tc.feed)))
+			for _, title := range tc.want {
+				if !strings.Contains(feed, "<title>"+title+"</title>") {
+					t.Errorf("%s doesn't contain %q:\n%s", tc.feed, title, feed)
+				}
+			}
+			for _, title := range tc.notWant {
+				if strings.Contains(feed, "<title>"+title+"</title>") {
+					t.Errorf("%s contains %q:\n%s", tc.feed, title, feed)
+				}
+			}
+			listingURL := "https://astrophena.name/" + strings.TrimSuffix(tc.listing, ".html")
+			if !strings.Contains(feed, `<link href="`+listingURL+`"></link>`) {
+				t.Errorf("%s doesn't link to %s:\n%s", tc.feed, listingURL, feed)
+			}
+			link := `href="/` + tc.feed + `"`
+			if listing := readFile(t, filepath.Join(dst, tc.listing)); !strings.Contains(listing, link) {
+				t.Errorf("%s doesn't advertise %s:\n%s", tc.listing, tc.feed, listing)
+			}
+			if post := readFile(t, filepath.Join(dst, "blog", "a-post.html")); strings.Contains(post, link) {
+				t.Errorf("non-listing page advertises %s:\n%s", tc.feed, post)
+			}
+		})
+	}
+
+	mainFeed := readFile(t, filepath.Join(dst, "feed.xml"))
+	if strings.Contains(mainFeed, "<title>A note</title>") {
+		t.Errorf("site-wide feed contains a note:\n%s", mainFeed)
+	}
+}
+
+func TestCategoryFeedsValidation(t *testing.T) {
+	cases := map[string]*Config{
+		"relative path": {CategoryFeeds: map[string]string{"post": "blog"}},
+		"root":          {TagFeeds: map[string]string{"go": "/"}},
+		"duplicate":     {CategoryFeeds: map[string]string{"post": "/blog"}, TagFeeds: map[string]string{"go": "/blog"}},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := c.validate(); err == nil {
+				t.Fatal("want error, got nil")
+			}
+		})
+	}
+}
+
+func TestEmptyPageWarning(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/empty.html --
+{{ if false }}{{ content . }}{{ end }}
+-- templates/layout.html --
+<html>{{ content . }}</html>
+-- pages/empty.html --
+{
+  "title": "Empty",
+  "template": "empty",
+  "permalink": "/empty"
+}
+
+<p>Hello!</p>
+-- pages/tiny.html --
+{
+  "title": "Tiny",
+  "template": "layout",
+  "permalink": "/tiny"
+}
+
+<p>Hi</p>
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<p>This page is long enough to not trigger a warning.</p>
+`
+
+	var logs []string
+	buildSite(t, ar, &Config{
+		MinPageSize: 30,
+		Logf: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	})
+
+	var warnings []string
+	for _, l := range logs {
+		if strings.HasPrefix(l, "Warning: ") {
+			warnings = append(warnings, l)
+		}
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("want 2 warnings, got %d: %q", len(warnings), warnings)
+	}
+	for _, w := range warnings {
+		if strings.Contains(w, "index.html") {
+			t.Errorf("unexpected warning for a normal page: %s", w)
+		}
+	}
+	var sawEmpty bool
+	for _, w := range warnings {
+		if strings.Contains(w, "empty.html") && strings.Contains(w, `template "empty"`) && strings.Contains(w, "(0 bytes)") {
+			sawEmpty = true
+		}
+	}
+	if !sawEmpty {
+		t.Errorf("no warning about empty page with its template name: %q", warnings)
+	}
+}
+
+func TestAbsolutizeLinks(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<a href="/">Home</a>
+{{ content . }}
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "type": "post",
+  "permalink": "/"
+}
+
+[foo](/foo), [bar](/bar?x=1#baz), [frag](#frag), [ext](https://example.com/x) and [proto](//example.com/y).
+
+![img](/img.png)
+`
+
+	cases := map[string]struct {
+		prod, absolutize bool
+		want, dontWant   []string
+	}{
+		"prod": {
+			prod:       true,
+			absolutize: true,
+			want: []string{
+				`<a href="https://astrophena.name/">Home</a>`,
+				`href="https://astrophena.name/foo"`,
+				`href="https://astrophena.name/bar?x=1#baz"`,
+				`src="https://astrophena.name/img.png"`,
+				`href="#frag"`,
+				`href="https://example.com/x"`,
+				`href="//example.com/y"`,
+			},
+		},
+		"prod without AbsolutizeLinks": {
+			prod:     true,
+			want:     []string{`href="/foo"`},
+			dontWant: []string{`href="https://astrophena.name/foo"`},
+		},
+		"dev": {
+			absolutize: true,
+			want:       []string{`href="/foo"`},
+			dontWant:   []string{`href="https://astrophena.name/foo"`},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dst := buildSite(t, ar, &Config{Prod: tc.prod, AbsolutizeLinks: tc.absolutize})
+			for _, f := range []string{"index.html", "feed.xml"} {
+				got := readFile(t, filepath.Join(dst, f))
+				if f == "feed.xml" {
+					// Feed content is escaped.
+					got = html.UnescapeString(got)
+				}
+				for _, want := range tc.want {
+					if f == "feed.xml" && strings.Contains(want, "Home") {
+						continue
+					}
+					if !strings.Contains(got, want) {
+						t.Errorf("%s: want %s in output:\n%s", f, want, got)
+					}
+				}
+				for _, dontWant := range tc.dontWant {
+					if strings.Contains(got, dontWant) {
+						t.Errorf("%s: don't want %s in output:\n%s", f, dontWant, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBuildError(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/broken.md --
+{
+  "title": "Broken",
+  "template": "layout",
+  "permalink": "/broken"
+}
+
+{{ .DoesNotExist }}
+-- pages/missing.md --
+`
+
+	cases := map[string]struct {
+		ar        string
+		wantPath  string
+		wantPhase Phase
+		wantErr   error
+	}{
+		"render": {
+			ar:        strings.TrimSuffix(ar, "-- pages/missing.md --\n"),
+			wantPath:  "broken.md",
+			wantPhase: PhaseRender,
+		},
+		"parse": {
+			ar:        ar + "Hello.\n",
+			wantPath:  "missing.md",
+			wantPhase: PhaseParse,
+			wantErr:   errFrontmatterMissing,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf}
+			testutil.ExtractTxtar(t, txtar.Parse([]byte(tc.ar)), c.Src)
+
+			err := Build(c)
+			var be *BuildError
+			if !errors.As(err, &be) {
+				t.Fatalf("want *BuildError, got %v", err)
+			}
+			testutil.AssertEqual(t, filepath.Base(be.Path), tc.wantPath)
+			testutil.AssertEqual(t, be.Phase, tc.wantPhase)
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Fatalf("want error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestFeedSelfURL(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+`
+	const self = "https://cdn.example.com/feeds/atom.xml"
+
+	dst := buildSite(t, ar, &Config{FeedSelfURL: self})
+	feed := readFile(t, filepath.Join(dst, "feed.xml"))
+	for _, want := range []string{
+		"<id>" + self + "</id>",
+		`<link href="` + self + `" rel="self"></link>`,
+		`<link href="https://astrophena.name/"></link>`,
+	} {
+		if !strings.Contains(feed, want) {
+			t.Errorf("want %s in feed:\n%s", want, feed)
+		}
+	}
+
+	c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf, FeedSelfURL: "/feed.xml"}
+	if err := Build(c); err == nil {
+		t.Fatal("Build must fail with relative FeedSelfURL")
+	}
+}
+
+func TestDraftsDst(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ range pages "post" }}{{ .Title }};{{ end }}
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+-- pages/draft.md --
+{
+  "title": "Draft",
+  "template": "layout",
+  "type": "post",
+  "permalink": "/blog/draft",
+  "draft": true
+}
+
+Work in progress.
+`
+
+	draftsDst := filepath.Join(t.TempDir(), "drafts")
+	dst := buildSite(t, ar, &Config{Prod: true, DraftsDst: draftsDst})
+
+	if _, err := os.Stat(filepath.Join(dst, "blog", "draft.html")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("draft must not be present in main output (stat error: %v)", err)
+	}
+	if feed := readFile(t, filepath.Join(dst, "feed.xml")); strings.Contains(feed, "Draft") {
+		t.Errorf("draft must not be present in feed:\n%s", feed)
+	}
+	if index := readFile(t, filepath.Join(dst, "index.html")); strings.Contains(index, "Draft") {
+		t.Errorf("draft must not be listed on other pages:\n%s", index)
+	}
+
+	draft := readFile(t, filepath.Join(draftsDst, "blog", "draft.html"))
+	if !strings.Contains(draft, "<p>Work in progress.</p>") {
+		t.Errorf("unexpected draft contents:\n%s", draft)
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	const ar = `
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<h1>Hello, <em>world</em>!</h1>
+-- pages/first.md --
+{
+  "title": "First",
+  "template": "layout",
+  "type": "post",
+  "date": "2022-02-14",
+  "permalink": "/blog/first"
+}
+
+One two **three**.
+-- pages/second.md --
+{
+  "title": "Second",
+  "template": "layout",
+  "type": "post",
+  "date": "2024-03-10",
+  "permalink": "/blog/second"
+}
+
+{{ range pages "post" }}{{ .Title }} {{ end }}and some more words.
+`
+
+	c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf}
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+
+	st, err := ComputeStats(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		first = time.Date(2022, time.February, 14, 0, 0, 0, 0, time.UTC)
+		last  = time.Date(2024, time.March, 10, 0, 0, 0, 0, time.UTC)
+	)
+	testutil.AssertEqual(t, st, &Stats{
+		Pages: 3,
+		Posts: 2,
+		Words: 11,
+		WordsByType: map[string]int{
+			"page": 2,
+			"post": 9,
+		},
+		FirstPost: &first,
+		LastPost:  &last,
+	})
+
+	// Nothing should be written.
+	entries, err := os.ReadDir(c.Dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Fatalf("ComputeStats wrote %d files to Dst", len(entries))
+	}
+}
+
+func TestPrefixHeadingIDs(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/hello.md --
+{
+  "title": "Hello",
+  "template": "layout",
+  "permalink": "/blog/hello"
+}
+
+See [usage](#usage) and [elsewhere](#nowhere).
+
+## Usage {#usage}
+
+Use it.
+-- pages/custom.md --
+{
+  "title": "Custom",
+  "template": "layout",
+  "permalink": "/custom",
+  "heading_id_prefix": "c"
+}
+
+<h3 class="x" id="intro">Intro</h3>
+
+[Intro](#intro)
+`
+
+	cases := map[string]struct {
+		prefix bool
+		file   string
+		want   []string
+	}{
+		"slug prefix": {
+			prefix: true,
+			file:   "blog/hello.html",
+			want: []string{
+				`<h2 id="hello-usage">Usage <a class="anchor" href="#hello-usage">#</a></h2>`,
+				`<a href="#hello-usage">usage</a>`,
+				`<a href="#nowhere">elsewhere</a>`,
+			},
+		},
+		"custom prefix": {
+			prefix: true,
+			file:   "custom.html",
+			want: []string{
+				`<h3 class="x" id="c-intro">Intro <a class="anchor" href="#c-intro">#</a></h3>`,
+				`<a href="#c-intro">Intro</a>`,
+			},
+		},
+		"disabled": {
+			file: "blog/hello.html",
+			want: []string{
+				`<h2 id="usage">Usage <a class="anchor" href="#usage">#</a></h2>`,
+				`<a href="#usage">usage</a>`,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dst := buildSite(t, ar, &Config{PrefixHeadingIDs: tc.prefix})
+			got := readFile(t, filepath.Join(dst, tc.file))
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("want %s in output:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWebmentionLinks(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<head>{{ webmentionLinks }}</head>
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<p>Hello!</p>
+`
+	c := &Config{
+		WebmentionEndpoint: "https://webmention.io/example.com/webmention",
+		MicropubEndpoint:   "https://example.com/micropub",
+	}
+	dst := buildSite(t, ar, c)
+
+	index := readFile(t, filepath.Join(dst, "index.html"))
+	for _, want := range []string{
+		`<link rel="webmention" href="https://webmention.io/example.com/webmention" />`,
+		`<link rel="micropub" href="https://example.com/micropub" />`,
+	} {
+		if !strings.Contains(index, want) {
+			t.Errorf("want %s in output:\n%s", want, index)
+		}
+	}
+
+	h := &staticHandler{fs: os.DirFS(dst), c: c}
+	for path, wantLink := range map[string]string{
+		"/":     `<https://webmention.io/example.com/webmention>; rel="webmention", <https://example.com/micropub>; rel="micropub"`,
+		"/test": "",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		testutil.AssertEqual(t, w.Code, http.StatusOK)
+		testutil.AssertEqual(t, w.Header().Get("Link"), wantLink)
+	}
+}
+
+func TestBasePathStrip(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"index.html": "index",
+		"foo.html":   "foo",
+		"404.html":   "not found",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := &staticHandler{fs: os.DirFS(dir), c: &Config{BasePathStrip: "/blog"}}
+	cases := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{path: "/blog/foo", wantStatus: http.StatusOK, wantBody: "foo"},
+		{path: "/blog/", wantStatus: http.StatusOK, wantBody: "index"},
+		{path: "/blog", wantStatus: http.StatusOK, wantBody: "index"},
+		{path: "/foo", wantStatus: http.StatusNotFound, wantBody: "not found"},
+		{path: "/blogfoo", wantStatus: http.StatusNotFound, wantBody: "not found"},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if w.Code != tc.wantStatus {
+			t.Errorf("GET %s: want status code %d, got %d", tc.path, tc.wantStatus, w.Code)
+		}
+		testutil.AssertEqual(t, w.Body.String(), tc.wantBody)
+	}
+}
+
+func TestPreloadLinks(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<head>{{ preloadLinks . }}</head>
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/",
+  "css": ["/css/main.css"],
+  "js": ["/js/main.js"]
+}
+-- pages/preload.html --
+{
+  "title": "Preload",
+  "template": "layout",
+  "permalink": "/preload",
+  "preload": true,
+  "css": ["/css/preload.css"]
+}
+`
+	const (
+		mainCSS    = `<link rel="preload" href="https://astrophena.name/css/main.css" as="style" />`
+		mainJS     = `<link rel="preload" href="https://astrophena.name/js/main.js" as="script" />`
+		preloadCSS = `<link rel="preload" href="https://astrophena.name/css/preload.css" as="style" />`
+	)
+
+	cases := map[string]struct {
+		global   bool
+		file     string
+		want     []string
+		dontWant []string
+	}{
+		"global":            {global: true, file: "index.html", want: []string{mainCSS, mainJS}},
+		"disabled":          {file: "index.html", dontWant: []string{mainCSS, mainJS}},
+		"enabled for page":  {file: "preload.html", want: []string{preloadCSS}},
+		"global, page also": {global: true, file: "preload.html", want: []string{preloadCSS}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dst := buildSite(t, ar, &Config{Preload: tc.global, Prod: true})
+			got := readFile(t, filepath.Join(dst, tc.file))
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("want %s in output:\n%s", want, got)
+				}
+			}
+			for _, dontWant := range tc.dontWant {
+				if strings.Contains(got, dontWant) {
+					t.Errorf("don't want %s in output:\n%s", dontWant, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBodyClass(t *testing.T) {
+	cases := map[string]struct {
+		p    *Page
+		want string
+	}{
+		"default":  {p: &Page{}, want: "page type-page"},
+		"post":     {p: &Page{Type: "post", Tags: []string{"Go", "Web Development", "C++"}}, want: "page type-post tag-go tag-web-development tag-c"},
+		"override": {p: &Page{Type: "post", Tags: []string{"go"}, BodyClass: "custom"}, want: "custom"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			testutil.AssertEqual(t, bodyClass(tc.p), tc.want)
+		})
+	}
+}
+
+func TestPageMethods(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+url={{ .URL }} words={{ .WordCount }} minutes={{ .ReadingTime }}
+-- templates/funcs.html --
+url={{ .URL }} words={{ wordCount . }} minutes={{ readingTime . }}
+-- pages/hello.md --
+{
+  "title": "Hello",
+  "template": "layout",
+  "permalink": "/hello"
+}
+
+Hello, *world*!
+-- pages/funcs.md --
+{
+  "title": "Funcs",
+  "template": "funcs",
+  "permalink": "/funcs"
+}
+
+Hello, *world*!
+`
+	dst := buildSite(t, ar, &Config{Prod: true})
+	cases := map[string]string{
+		"hello.html": "url=https://astrophena.name/hello words=2 minutes=1",
+		"funcs.html": "url=https://astrophena.name/funcs words=2 minutes=1",
+	}
+	for file, want := range cases {
+		t.Run(file, func(t *testing.T) {
+			got := readFile(t, filepath.Join(dst, file))
+			testutil.AssertEqual(t, strings.TrimSpace(got), want)
+		})
+	}
+}
+
+func TestCheckHead(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/good.html --
+<head><meta charset="utf-8" /><meta name="viewport" content="width=device-width" /></head>
+{{ content . }}
+-- templates/nocharset.html --
+<head><meta name="viewport" content="width=device-width" /></head>
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "good",
+  "permalink": "/"
+}
+-- pages/broken.html --
+{
+  "title": "Broken",
+  "template": "nocharset",
+  "permalink": "/broken"
+}
+`
+
+	t.Run("warn", func(t *testing.T) {
+		var warnings []string
+		buildSite(t, ar, &Config{
+			CheckHead: "warn",
+			Logf: func(format string, args ...any) {
+				if l := fmt.Sprintf(format, args...); strings.HasPrefix(l, "Warning: ") {
+					warnings = append(warnings, l)
+				}
+			},
+		})
+		if len(warnings) != 1 {
+			t.Fatalf("want 1 warning, got %d: %q", len(warnings), warnings)
+		}
+		if !strings.Contains(warnings[0], "broken.html: missing charset meta tag") {
+			t.Errorf("unexpected warning: %q", warnings[0])
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		c := &Config{
+			Src:       t.TempDir(),
+			Dst:       t.TempDir(),
+			Logf:      t.Logf,
+			CheckHead: "strict",
+		}
+		testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+		err := Build(c)
+		var be *BuildError
+		if !errors.As(err, &be) {
+			t.Fatalf("want *BuildError, got %v", err)
+		}
+		testutil.AssertEqual(t, be.Phase, PhaseRender)
+		testutil.AssertEqual(t, filepath.Base(be.Path), "broken.html")
+	})
+}
+
+func TestGenerateOGImages(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<meta property="og:image" content="{{ ogImage . }}" />
+{{ content . }}
+-- pages/post.md --
+{
+  "title": "Hello, world!",
+  "template": "layout",
+  "permalink": "/hello",
+  "type": "post"
+}
+
+Hello!
+-- pages/explicit.md --
+{
+  "title": "Explicit",
+  "template": "layout",
+  "permalink": "/explicit",
+  "image": "/images/explicit.png"
+}
+
+Explicit.
+`
+	dst := buildSite(t, ar, &Config{GenerateOGImages: true})
+
+	cards, err := filepath.Glob(filepath.Join(dst, "og", "*.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 1 {
+		t.Fatalf("want 1 generated image, got %d: %v", len(cards), cards)
+	}
+	b, err := os.ReadFile(cards[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("\x89PNG")) {
+		t.Fatalf("%s doesn't look like PNG", cards[0])
+	}
+
+	post := readFile(t, filepath.Join(dst, "hello.html"))
+	want := `<meta property="og:image" content="/og/` + filepath.Base(cards[0]) + `" />`
+	if !strings.Contains(post, want) {
+		t.Errorf("hello.html doesn't contain %s", want)
+	}
+	explicit := readFile(t, filepath.Join(dst, "explicit.html"))
+	if want := `<meta property="og:image" content="/images/explicit.png" />`; !strings.Contains(explicit, want) {
+		t.Errorf("explicit.html doesn't contain %s", want)
+	}
+}
+
+func TestServeFromMemory(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<p>Before</p>
+`
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "build")
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), src)
+
+	addr := startServer(t, &Config{
+		Src:             src,
+		Dst:             dst,
+		Logf:            t.Logf,
+		SkipFeed:        true,
+		ServeFromMemory: true,
+	})
+
+	get := func() string {
+		res, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if got := get(); !strings.Contains(got, "<p>Before</p>") {
+		t.Fatalf("want initial content, got %q", got)
+	}
+	if _, err := os.Stat(dst); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Dst shouldn't be written to, got %v", err)
+	}
+
+	index := filepath.Join(src, "pages", "index.html")
+	updated := strings.Replace(readFile(t, index), "Before", "After", 1)
+	if err := os.WriteFile(index, []byte(updated), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got := get(); strings.Contains(got, "<p>After</p>") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rebuild didn't update served content")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestCheckNavLinks(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<nav>{{ navLink . "Drafts" "drafts" "/drafts" }}</nav>
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+-- pages/about.html --
+{
+  "title": "About",
+  "template": "layout",
+  "permalink": "/about"
+}
+-- pages/drafts.html --
+{
+  "title": "Drafts",
+  "template": "layout",
+  "permalink": "/drafts",
+  "draft": true
+}
+`
+
+	t.Run("warn", func(t *testing.T) {
+		var warnings []string
+		dst := buildSite(t, ar, &Config{
+			Prod:          true,
+			CheckNavLinks: "warn",
+			Logf: func(format string, args ...any) {
+				if l := fmt.Sprintf(format, args...); strings.HasPrefix(l, "Warning: ") {
+					warnings = append(warnings, l)
+				}
+			},
+		})
+		// Warned only once, despite being on two pages.
+		testutil.AssertEqual(t, warnings, []string{`Warning: navigation link "/drafts" points to a page that isn't built`})
+		if !strings.Contains(readFile(t, filepath.Join(dst, "index.html")), `/drafts"`) {
+			t.Errorf("navigation link shouldn't be omitted")
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		dst := buildSite(t, ar, &Config{Prod: true, CheckNavLinks: "skip"})
+		if strings.Contains(readFile(t, filepath.Join(dst, "index.html")), `/drafts"`) {
+			t.Errorf("navigation link should be omitted")
+		}
+	})
+
+	t.Run("dev", func(t *testing.T) {
+		var warnings []string
+		buildSite(t, ar, &Config{
+			CheckNavLinks: "strict",
+			Logf: func(format string, args ...any) {
+				if l := fmt.Sprintf(format, args...); strings.HasPrefix(l, "Warning: ") {
+					warnings = append(warnings, l)
+				}
+			},
+		})
+		if len(warnings) > 0 {
+			t.Errorf("want no warnings in development build, got %q", warnings)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		c := &Config{
+			Src:           t.TempDir(),
+			Dst:           t.TempDir(),
+			Logf:          t.Logf,
+			Prod:          true,
+			CheckNavLinks: "strict",
+		}
+		testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+		err := Build(c)
+		var be *BuildError
+		if !errors.As(err, &be) {
+			t.Fatalf("want *BuildError, got %v", err)
+		}
+		testutil.AssertEqual(t, be.Phase, PhaseRender)
+		if !strings.Contains(err.Error(), `navigation link "/drafts"`) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestForEachConcurrency(t *testing.T) {
+	pages := make([]*Page, 16)
+	for i := range pages {
+		pages[i] = &Page{Title: fmt.Sprint(i)}
+	}
+
+	for _, n := range []int{1, 4} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			b := newBuildContext(&Config{Concurrency: n})
+
+			var (
+				mu           sync.Mutex
+				order        []string
+				active, peak atomic.Int32
+			)
+			if err := b.forEach(pages, func(p *Page) error {
+				cur := active.Add(1)
+				defer active.Add(-1)
+				for {
+					old := peak.Load()
+					if cur <= old || peak.CompareAndSwap(old, cur) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				order = append(order, p.Title)
+				mu.Unlock()
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := int(peak.Load()); got > n {
+				t.Errorf("want at most %d concurrent calls, got %d", n, got)
+			}
+			if len(order) != len(pages) {
+				t.Fatalf("want %d calls, got %d", len(pages), len(order))
+			}
+			if n == 1 {
+				for i, title := range order {
+					if title != pages[i].Title {
+						t.Fatalf("want serialized execution in order, got %v", order)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBuildSummary(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+-- pages/draft.html --
+{
+  "title": "Draft",
+  "template": "layout",
+  "permalink": "/draft",
+  "draft": true
+}
+`
+	cases := map[string]struct {
+		c        *Config
+		want     []string
+		wantWarn bool
+	}{
+		"development": {
+			c: &Config{},
+		},
+		"production": {
+			c: &Config{Prod: true},
+			want: []string{
+				"Built 1 pages in production mode:",
+				"  drafts: excluded",
+				"  feed: built with absolute URLs",
+				"  url function: absolute URLs",
+			},
+		},
+		"development for deploy": {
+			c: &Config{Deploy: true},
+			want: []string{
+				"Built 2 pages in development mode:",
+				"  drafts: included",
+				"  feed: built with absolute URLs",
+				"  url function: root-relative URLs",
+			},
+			wantWarn: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var logs []string
+			tc.c.Logf = func(format string, args ...any) {
+				logs = append(logs, fmt.Sprintf(format, args...))
+			}
+			buildSite(t, ar, tc.c)
+
+			var summary []string
+			var warned bool
+			for _, l := range logs {
+				if strings.HasPrefix(l, "Built ") {
+					summary = strings.Split(l, "\n")
+				}
+				if l == "Warning: building for deploy, but not in production mode" {
+					warned = true
+				}
+			}
+			if tc.want == nil && summary != nil {
+				t.Errorf("summary logged for a development build: %q", summary)
+			}
+			for _, want := range tc.want {
+				testutil.AssertContains(t, summary, want)
+			}
+			testutil.AssertEqual(t, warned, tc.wantWarn)
+		})
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	const ar = `
+-- static/css/main.css --
+body {}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<h1>Hello, <em>world</em>!</h1>
+-- pages/post.md --
+{
+  "title": "Post",
+  "template": "layout",
+  "type": "post",
+  "date": "2024-03-10",
+  "permalink": "/blog/post",
+  "tags": ["go"]
+}
+
+One two **three**.
+`
+
+	c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf, Prod: true}
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+
+	m, err := Analyze(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2024, time.March, 10, 0, 0, 0, 0, time.UTC)
+	testutil.AssertEqual(t, m, &SiteModel{
+		Pages: []*PageModel{
+			{
+				Title:     "Post",
+				Permalink: "/blog/post",
+				URL:       "https://astrophena.name/blog/post",
+				Type:      "post",
+				Tags:      []string{"go"},
+				Date:      &date,
+				WordCount: 3,
+				Source:    filepath.Join(c.Src, "pages", "post.md"),
+			},
+			{
+				Title:     "Index",
+				Permalink: "/",
+				URL:       "https://astrophena.name/",
+				Type:      "page",
+				WordCount: 2,
+				Source:    filepath.Join(c.Src, "pages", "index.html"),
+			},
+		},
+		Static: map[string]string{
+			"css/main.css": "https://astrophena.name/css/main.css",
+		},
+	})
+
+	// Nothing is written.
+	entries, err := os.ReadDir(c.Dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("Analyze wrote to Dst: %v", entries)
+	}
+}
+
+func TestScripts(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<head>{{ scripts . }}</head>
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/",
+  "js": [
+    "/js/plain.js",
+    {"src": "/js/app.js", "module": true, "defer": true},
+    {"src": "/js/stats.js", "async": true}
+  ]
+}
+`
+	dst := buildSite(t, ar, &Config{Prod: true})
+	got := readFile(t, filepath.Join(dst, "index.html"))
+	for _, want := range []string{
+		`<script src="https://astrophena.name/js/plain.js"></script>`,
+		`<script type="module" defer src="https://astrophena.name/js/app.js"></script>`,
+		`<script async src="https://astrophena.name/js/stats.js"></script>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("index.html doesn't contain %s", want)
+		}
+	}
+}
+
+func TestFeatureTemplateFunc(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+{{ if feature "comments" }}<section id="comments"></section>{{ end }}
+{{ if feature "unknown" }}<section id="unknown"></section>{{ end }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+`
+	cases := map[string]struct {
+		features map[string]bool
+		want     bool
+	}{
+		"enabled":  {features: map[string]bool{"comments": true}, want: true},
+		"disabled": {features: map[string]bool{"comments": false}},
+		"unset":    {},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dst := buildSite(t, ar, &Config{Features: tc.features})
+			got := readFile(t, filepath.Join(dst, "index.html"))
+			testutil.AssertEqual(t, strings.Contains(got, `id="comments"`), tc.want)
+			if strings.Contains(got, `id="unknown"`) {
+				t.Errorf("unknown feature shouldn't be enabled")
+			}
+		})
+	}
+}
+
+func TestStrictFrontMatter(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/",
+  "permalinks": "/typo"
+}
+`
+	t.Run("lenient", func(t *testing.T) {
+		buildSite(t, ar, &Config{})
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		c := &Config{
+			Src:               t.TempDir(),
+			Dst:               t.TempDir(),
+			Logf:              t.Logf,
+			StrictFrontMatter: true,
+		}
+		testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+		err := Build(c)
+		if !errors.Is(err, errFrontmatterParse) {
+			t.Fatalf("want errFrontmatterParse, got %v", err)
+		}
+		for _, want := range []string{"index.html", `"permalinks"`} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error %q doesn't mention %s", err, want)
+			}
+		}
+	})
+}
+
+func TestBuildScriptChdir(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping building build.go in short mode")
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(t.TempDir(), "build")
+	if out, err := exec.Command("go", "build", "-o", bin, "build.go").CombinedOutput(); err != nil {
+		t.Fatalf("building build.go: %v\n%s", err, out)
+	}
+
+	dst := filepath.Join(t.TempDir(), "out")
+	cmd := exec.Command(bin, "-C", root, "-skip-starplay", dst)
+	cmd.Dir = t.TempDir()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("running build.go: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "index.html")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildScriptSrc(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping building build.go in short mode")
+	}
+
+	bin := filepath.Join(t.TempDir(), "build")
+	if out, err := exec.Command("go", "build", "-o", bin, "build.go").CombinedOutput(); err != nil {
+		t.Fatalf("building build.go: %v\n%s", err, out)
+	}
+
+	const ar = `
+-- go.mod --
+module example.com/site
+-- starplay/main.go --
+package main
+
+func main() {}
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+`
+	src := t.TempDir()
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), src)
+	dst := filepath.Join(t.TempDir(), "out")
+
+	// The current directory is neither the repo root nor SITE_SRC, so the
+	// script must look for go.mod and write the Starlark playground to SITE_SRC.
+	cwd := t.TempDir()
+	cmd := exec.Command(bin, dst)
+	cmd.Dir = cwd
+	cmd.Env = append(os.Environ(), "SITE_SRC="+src)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("running build.go: %v\n%s", err, out)
+	}
+	for _, name := range []string{
+		filepath.Join(src, "static", "wasm", "starplay.wasm"),
+		filepath.Join(src, "static", "js", "go_wasm_exec.js"),
+		filepath.Join(dst, "index.html"),
+		filepath.Join(dst, "wasm", "starplay.wasm"),
+	} {
+		if _, err := os.Stat(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cwd, "static")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("build.go wrote to the current directory: %v", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"SITE_SRC":      "/src",
+		"SITE_DST":      "/dst",
+		"SITE_BASE_URL": "https://example.com",
+	}
+
+	c := &Config{Prod: true}
+	if err := c.ApplyEnv(func(key string) string { return env[key] }); err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertEqual(t, c.Src, "/src")
+	testutil.AssertEqual(t, c.Dst, "/dst")
+	testutil.AssertEqual(t, c.BaseURL.String(), "https://example.com")
+	testutil.AssertEqual(t, c.Prod, true)
+
+	// Unset variables leave fields alone.
+	c = &Config{Dst: "/flag"}
+	if err := c.ApplyEnv(func(string) string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertEqual(t, c.Src, "")
+	testutil.AssertEqual(t, c.Dst, "/flag")
+	if c.BaseURL != nil {
+		t.Errorf("BaseURL shouldn't be set, got %v", c.BaseURL)
+	}
+
+	// Relative base URL is rejected.
+	c = &Config{}
+	if err := c.ApplyEnv(func(key string) string {
+		if key == "SITE_BASE_URL" {
+			return "/relative"
+		}
+		return ""
+	}); err == nil {
+		t.Error("want error for relative SITE_BASE_URL")
+	}
+}
+
+func TestRenderPage(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<h1>Home</h1>
+{{ renderPage "/about" }}
+-- pages/about.md --
+{
+  "title": "About",
+  "template": "layout",
+  "permalink": "/about"
+}
+
+This is *about* page.
+`
+	dst := buildSite(t, ar, &Config{})
+	index := readFile(t, filepath.Join(dst, "index.html"))
+	if want := "<p>This is <em>about</em> page.</p>"; !strings.Contains(index, want) {
+		t.Errorf("index.html doesn't contain %s:\n%s", want, index)
+	}
+	// Embedded page is still built on its own, and only rendered once.
+	about := readFile(t, filepath.Join(dst, "about.html"))
+	testutil.AssertEqual(t, strings.TrimSpace(about), "<p>This is <em>about</em> page.</p>")
+}
+
+func TestRenderPageCycle(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/a.html --
+{
+  "title": "A",
+  "template": "layout",
+  "permalink": "/a"
+}
+
+{{ renderPage "/b" }}
+-- pages/b.html --
+{
+  "title": "B",
+  "template": "layout",
+  "permalink": "/b"
+}
+
+{{ renderPage "/a" }}
+`
+	c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf}
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+	err := Build(c)
+	if err == nil || !strings.Contains(err.Error(), "page embeds itself") {
+		t.Fatalf("want cycle error, got %v", err)
+	}
+}
+
+func TestFinalNewline(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+
+
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<p>No newline</p>
+`
+	cases := map[string]struct {
+		skip bool
+		want string
+	}{
+		"default":  {want: "\n<p>No newline</p>\n"},
+		"disabled": {skip: true, want: "\n<p>No newline</p>\n\n\n\n"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dst := buildSite(t, ar, &Config{SkipFinalNewline: tc.skip})
+			testutil.AssertEqual(t, readFile(t, filepath.Join(dst, "index.html")), tc.want)
+			if !tc.skip {
+				feed := readFile(t, filepath.Join(dst, "feed.xml"))
+				if !strings.HasSuffix(feed, ">\n") {
+					t.Errorf("feed.xml doesn't end with a single newline: %q", feed[len(feed)-10:])
+				}
+			}
+		})
+	}
+}
+
+func TestPageDate(t *testing.T) {
+	page := func(date string) string {
+		return `
+-- static/test --
+test
+-- templates/layout.html --
+{{ .Date.Format "2006-01-02 15:04" }}
+-- pages/post.html --
+{
+  "title": "Post",
+  "template": "layout",
+  "permalink": "/post",
+  "date": "` + date + `"
+}
+`
+	}
+
+	cases := map[string]struct {
+		date      string
+		allowTime bool
+		want      string
+		wantErr   []string
+	}{
+		"date":               {date: "2024-01-02", want: "2024-01-02 00:00"},
+		"slashes":            {date: "2024/01/02", wantErr: []string{"post.html", `"2024/01/02"`, "2006-01-02"}},
+		"time not allowed":   {date: "2024-01-02T15:04:05Z", wantErr: []string{"post.html", "AllowDateTime"}},
+		"time allowed":       {date: "2024-01-02T15:04:05Z", allowTime: true, want: "2024-01-02 15:04"},
+		"date, time allowed": {date: "2024-01-02", allowTime: true, want: "2024-01-02 00:00"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c := &Config{
+				Src:           t.TempDir(),
+				Dst:           t.TempDir(),
+				Logf:          t.Logf,
+				SkipFeed:      true,
+				AllowDateTime: tc.allowTime,
+			}
+			testutil.ExtractTxtar(t, txtar.Parse([]byte(page(tc.date))), c.Src)
+			err := Build(c)
+			if tc.wantErr != nil {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				for _, want := range tc.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q doesn't mention %s", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.AssertEqual(t, strings.TrimSpace(readFile(t, filepath.Join(c.Dst, "post.html"))), tc.want)
+		})
+	}
+}
+
+func TestRedirectRules(t *testing.T) {
+	const ar = `
+-- static/old/kept.html --
+kept
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+`
+	c := &Config{
+		SkipFeed: true,
+		RedirectRules: []RedirectRule{
+			{From: "/old/*", To: "/new/:splat"},
+			{From: "/posts/:year/:slug", To: "/blog/:slug?year=:year", Status: http.StatusFound},
+		},
+	}
+	dst := buildSite(t, ar, c)
+	testutil.AssertEqual(t, readFile(t, filepath.Join(dst, "_redirects")), "/old/* /new/:splat 301\n/posts/:year/:slug /blog/:slug?year=:year 302\n")
+
+	h := &staticHandler{fs: os.DirFS(dst), c: c}
+	cases := map[string]struct {
+		path       string
+		wantStatus int
+		wantTo     string
+	}{
+		"splat":             {path: "/old/a/b", wantStatus: http.StatusMovedPermanently, wantTo: "/new/a/b"},
+		"placeholders":      {path: "/posts/2024/hello", wantStatus: http.StatusFound, wantTo: "/blog/hello?year=2024"},
+		"too many segments": {path: "/posts/2024/hello/world", wantStatus: http.StatusNotFound},
+		"file shadows rule": {path: "/old/kept", wantStatus: http.StatusOK},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			testutil.AssertEqual(t, w.Code, tc.wantStatus)
+			testutil.AssertEqual(t, w.Header().Get("Location"), tc.wantTo)
+		})
+	}
+}
+
+func TestRedirectRuleValidation(t *testing.T) {
+	cases := map[string]RedirectRule{
+		"relative from":   {From: "old", To: "/new"},
+		"empty to":        {From: "/old"},
+		"splat in middle": {From: "/old/*/page", To: "/new"},
+		"partial splat":   {From: "/old/a*", To: "/new"},
+		"bad status":      {From: "/old", To: "/new", Status: http.StatusOK},
+	}
+	for name, r := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := (&Config{RedirectRules: []RedirectRule{r}}).validate(); err == nil {
+				t.Fatal("want error, got nil")
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "access.log")
+	f, err := os.Create(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	addr := startServer(t, &Config{
+		Dst:       t.TempDir(),
+		Logf:      t.Logf,
+		AccessLog: f,
+	})
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/does-not-exist?q=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "test-agent")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	lineRe := regexp.MustCompile(`^(127\.0\.0\.1|::1) - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /does-not-exist\?q=1 HTTP/1\.1" 404 \d+ "-" "test-agent"\n$`)
+	if got := readFile(t, logFile); !lineRe.MatchString(got) {
+		t.Errorf("access log doesn't contain a CLF line: %q", got)
+	}
+}
+
+func TestLiveReloadWithAccessLog(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<html><body>{{ content . }}</body></html>
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<p>Before</p>
+`
+	src := t.TempDir()
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), src)
+	addr := startServer(t, &Config{
+		Src:       src,
+		Dst:       t.TempDir(),
+		Logf:      t.Logf,
+		SkipFeed:  true,
+		AccessLog: io.Discard,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/_reload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Body.Close()
+	testutil.AssertEqual(t, events.StatusCode, http.StatusOK)
+	testutil.AssertEqual(t, events.Header.Get("Content-Type"), "text/event-stream")
+
+	index := filepath.Join(src, "pages", "index.html")
+	updated := strings.Replace(readFile(t, index), "Before", "After", 1)
+	if err := os.WriteFile(index, []byte(updated), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(events.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("no reload event received: %v", err)
+	}
+	testutil.AssertEqual(t, line, "event: reload\n")
+}
+
+func TestMoreMarker(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/blog.html --
+{
+  "title": "Blog",
+  "template": "layout",
+  "permalink": "/blog"
+}
+
+{{ range pages "post" }}<article>{{ .Excerpt }}</article><p class="summary">{{ .Summary }}</p>{{ end }}
+-- pages/post.md --
+{
+  "title": "Post",
+  "template": "layout",
+  "permalink": "/post",
+  "type": "post",
+  "date": "2024-01-02"
+}
+
+First *paragraph*.
+
+<!-- more -->
+
+Second paragraph.
+`
+	dst := buildSite(t, ar, &Config{})
+
+	post := readFile(t, filepath.Join(dst, "post.html"))
+	for _, want := range []string{"<p>First <em>paragraph</em>.</p>", "<p>Second paragraph.</p>"} {
+		if !strings.Contains(post, want) {
+			t.Errorf("post.html doesn't contain %s", want)
+		}
+	}
+	if strings.Contains(post, "more") {
+		t.Errorf("post.html contains the marker:\n%s", post)
+	}
+
+	blog := readFile(t, filepath.Join(dst, "blog.html"))
+	for _, want := range []string{
+		"<article><p>First <em>paragraph</em>.</p>",
+		`<p class="summary">First paragraph.</p>`,
+	} {
+		if !strings.Contains(blog, want) {
+			t.Errorf("blog.html doesn't contain %s:\n%s", want, blog)
+		}
+	}
+	if strings.Contains(blog, "Second paragraph") {
+		t.Errorf("excerpt contains text after the marker:\n%s", blog)
+	}
+
+	feed := readFile(t, filepath.Join(dst, "feed.xml"))
+	if want := "<summary type=\"html\">First paragraph.</summary>"; !strings.Contains(feed, want) {
+		t.Errorf("feed.xml doesn't contain %s:\n%s", want, feed)
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<p>Fine</p>
+-- pages/broken.html --
+{
+  "title": "Broken",
+  "template": "layout",
+  "permalink": "/broken"
+}
+
+{{ renderPage "/does-not-exist" }}
+-- pages/nolayout.html --
+{
+  "title": "No layout",
+  "template": "missing",
+  "permalink": "/nolayout"
+}
+`
+	t.Run("fail fast", func(t *testing.T) {
+		c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf}
+		testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+		if err := Build(c); err == nil {
+			t.Fatal("want error, got nil")
+		}
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		var warnings []string
+		dst := buildSite(t, ar, &Config{
+			ContinueOnError: true,
+			Logf: func(format string, args ...any) {
+				if l := fmt.Sprintf(format, args...); strings.HasPrefix(l, "Warning: ") {
+					warnings = append(warnings, l)
+				}
+			},
+		})
+		if len(warnings) != 2 {
+			t.Errorf("want 2 warnings, got %d: %q", len(warnings), warnings)
+		}
+		if got := readFile(t, filepath.Join(dst, "index.html")); !strings.Contains(got, "<p>Fine</p>") {
+			t.Errorf("index.html wasn't built: %q", got)
+		}
+		for file, want := range map[string]string{
+			"broken.html":   `no page with permalink &#34;/does-not-exist&#34;`,
+			"nolayout.html": `no such template &#34;missing&#34;`,
+		} {
+			got := readFile(t, filepath.Join(dst, file))
+			if !strings.Contains(got, "<h1>Failed to build") || !strings.Contains(got, want) {
+				t.Errorf("%s isn't an error page mentioning %s:\n%s", file, want, got)
+			}
+		}
+	})
+}
+
+func TestLazyImages(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+![Hero](/hero.png "eager")
+
+![Cat](/cat.png)
+
+<img src="/dog.png" alt="Dog" loading="eager">
+`
+	cases := map[string]struct {
+		lazy bool
+		want []string
+	}{
+		"enabled": {
+			lazy: true,
+			want: []string{
+				`<img src="/hero.png" alt="Hero" />`,
+				`<img loading="lazy" decoding="async" src="/cat.png" alt="Cat" />`,
+				`<img decoding="async" src="/dog.png" alt="Dog" loading="eager">`,
+			},
+		},
+		"disabled": {
+			want: []string{
+				`<img src="/hero.png" alt="Hero" title="eager" />`,
+				`<img src="/cat.png" alt="Cat" />`,
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dst := buildSite(t, ar, &Config{LazyImages: tc.lazy})
+			got := readFile(t, filepath.Join(dst, "index.html"))
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("index.html doesn't contain %s:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBundles(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- static/css/a.css --
+body { color: red; }
+-- static/css/b.css --
+p { margin: 0; }
+-- static/js/a.js --
+function hello( name ) {
+  return "Hello, " + name;
+}
+-- templates/layout.html --
+<link rel="stylesheet" href="{{ bundle "main.css" }}">
+<script src="{{ bundle "main.js" }}"></script>
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+`
+	dst := buildSite(t, ar, &Config{
+		Bundles: map[string][]string{
+			"main.css": {"css/a.css", "css/b.css"},
+			"main.js":  {"js/a.js"},
+		},
+	})
+
+	cases := map[string]string{
+		"main.*.css": "body{color:red}p{margin:0}",
+		"main.*.js":  `function hello(e){return"Hello, "+e}`,
+	}
+	index := readFile(t, filepath.Join(dst, "index.html"))
+	for pattern, want := range cases {
+		matches, err := filepath.Glob(filepath.Join(dst, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 1 {
+			t.Fatalf("want one bundle matching %s, got %v", pattern, matches)
+		}
+		got := readFile(t, matches[0])
+		testutil.AssertEqual(t, got, want)
+
+		// The name is derived from the minified contents.
+		sum := sha256.Sum256([]byte(got))
+		name := strings.Replace(pattern, "*", hex.EncodeToString(sum[:8]), 1)
+		testutil.AssertEqual(t, filepath.Base(matches[0]), name)
+
+		if ref := `="/` + name + `"`; !strings.Contains(index, ref) {
+			t.Errorf("index.html doesn't reference the bundle with %s:\n%s", ref, index)
+		}
+	}
+}
+
+func TestServeConditionalGet(t *testing.T) {
+	cases := map[string]*Config{
+		"disk":   {Dst: t.TempDir(), Logf: t.Logf},
+		"memory": {ServeFromMemory: true, Logf: t.Logf},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			addr := startServer(t, c)
+			url := "http://" + addr + "/feed.xml"
+
+			res, err := http.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			testutil.AssertEqual(t, res.StatusCode, http.StatusOK)
+			etag := res.Header.Get("ETag")
+			if etag == "" {
+				t.Fatal("no ETag header")
+			}
+
+			headers := map[string]string{"If-None-Match": etag}
+			if lm := res.Header.Get("Last-Modified"); lm != "" {
+				headers["If-Modified-Since"] = lm
+			}
+			for k, v := range headers {
+				req, err := http.NewRequest(http.MethodGet, url, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set(k, v)
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				if res.StatusCode != http.StatusNotModified {
+					t.Errorf("%s: want status %d, got %d", k, http.StatusNotModified, res.StatusCode)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyOutput(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- static/css/a.css --
+body { color: red; }
+-- templates/layout.html --
+<!DOCTYPE html>
+<html>
+<head>
+<title>{{ .Title }}</title>
+<link rel="stylesheet" href="{{ bundle "main.css" }}">
+<script>if (1 < 2) { document.write("<p>"); }</script>
+</head>
+<body>
+<ul><li>One<li>Two</ul>
+<br/>
+{{ content . }}
+</body>
+</html>
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+[About](/about?ref=index#top) and [test](/test).
+-- pages/about.md --
+{
+  "title": "About",
+  "template": "layout",
+  "permalink": "/about"
+}
+
+<div>Unclosed
+
+[Missing](/missing)
+`
+	c := &Config{
+		Src:          t.TempDir(),
+		Dst:          t.TempDir(),
+		Logf:         t.Logf,
+		Bundles:      map[string][]string{"main.css": {"css/a.css"}},
+		VerifyOutput: true,
+	}
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+	err := Build(c)
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	for _, want := range []string{
+		`about.html: unclosed <div> before </body>`,
+		`about.html: broken link "/missing"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't contain %q:\n%v", want, err)
+		}
+	}
+	// The index page is valid.
+	if got := strings.Count(err.Error(), "\n"); got != 1 {
+		t.Errorf("want exactly two problems, got:\n%v", err)
+	}
+}
+
+func TestTOC(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<nav>{{ toc . 3 }}</nav>
+{{ content . }}
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+## Getting *started*
+
+### Installing
+
+### Configuring
+
+#### Advanced
+
+## Usage
+-- pages/empty.md --
+{
+  "title": "Empty",
+  "template": "layout",
+  "permalink": "/empty"
+}
+
+No headings here.
+`
+	dst := buildSite(t, ar, &Config{})
+
+	want := `<nav><ul>
+<li><a href="#getting-started">Getting started</a>
+<ul>
+<li><a href="#installing">Installing</a></li>
+<li><a href="#configuring">Configuring</a></li>
+</ul></li>
+<li><a href="#usage">Usage</a></li>
+</ul></nav>`
+	if got := readFile(t, filepath.Join(dst, "index.html")); !strings.Contains(got, want) {
+		t.Errorf("index.html doesn't contain table of contents %s:\n%s", want, got)
+	}
+	if got := readFile(t, filepath.Join(dst, "empty.html")); !strings.Contains(got, "<nav></nav>") {
+		t.Errorf("empty.html has non-empty table of contents:\n%s", got)
+	}
+
+	// Headings don't get IDs when heading IDs are disabled.
+	dst = buildSite(t, ar, &Config{Markdown: MarkdownOptions{DisableHeadingID: true}})
+	if got := readFile(t, filepath.Join(dst, "index.html")); !strings.Contains(got, "<nav></nav>") || strings.Contains(got, "id=") {
+		t.Errorf("index.html has heading IDs with HeadingID disabled:\n%s", got)
+	}
+}
+
+func TestReadingTime(t *testing.T) {
+	words := strings.Repeat("word ", 450)
+	ar := `
+-- static/test --
+test
+-- templates/layout.html --
+minutes={{ readingTime . }}
+{{ content . }}
+-- pages/post.md --
+{
+  "title": "Post",
+  "template": "layout",
+  "permalink": "/post",
+  "type": "post"
+}
+
+` + words + `
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+{{ range pages "post" }}{{ .Title }}: {{ readingTime . }} min read{{ end }}
+`
+	cases := map[string]struct {
+		wpm       int
+		wantPost  string
+		wantIndex string
+	}{
+		"default":    {wantPost: "minutes=3\n", wantIndex: "Post: 3 min read"},
+		"fast":       {wpm: 450, wantPost: "minutes=1\n", wantIndex: "Post: 1 min read"},
+		"slow":       {wpm: 100, wantPost: "minutes=5\n", wantIndex: "Post: 5 min read"},
+		"rounded up": {wpm: 449, wantPost: "minutes=2\n", wantIndex: "Post: 2 min read"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dst := buildSite(t, ar, &Config{WordsPerMinute: tc.wpm})
+			if got := readFile(t, filepath.Join(dst, "post.html")); !strings.HasPrefix(got, tc.wantPost) {
+				t.Errorf("post.html doesn't start with %q:\n%s", tc.wantPost, got)
+			}
+			if got := readFile(t, filepath.Join(dst, "index.html")); !strings.Contains(got, tc.wantIndex) {
+				t.Errorf("index.html doesn't contain %q:\n%s", tc.wantIndex, got)
+			}
+		})
+	}
+
+	t.Run("from own contents", func(t *testing.T) {
+		const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+{{ readingTime . }} min read
+`
+		c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf}
+		testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+		if err := Build(c); err == nil || !strings.Contains(err.Error(), "call it from a layout") {
+			t.Fatalf("want error about calling from a layout, got %v", err)
+		}
+	})
+}
+
+func TestTagPages(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- templates/tag.html --
+{{ .Title }}: {{ content . }}
+-- pages/one.md --
+{
+  "title": "One",
+  "template": "layout",
+  "permalink": "/one",
+  "type": "post",
+  "tags": ["Web Development"]
+}
+-- pages/two.md --
+{
+  "title": "Two",
+  "template": "layout",
+  "permalink": "/two",
+  "type": "post",
+  "tags": ["%s"]
+}
+`
+	t.Run("location", func(t *testing.T) {
+		dst := buildSite(t, fmt.Sprintf(ar, "Web Development"), &Config{})
+		got := readFile(t, filepath.Join(dst, "tags", "web-development.html"))
+		if !strings.HasPrefix(got, "Web Development: <ul>") {
+			t.Errorf("unexpected tag page:\n%s", got)
+		}
+	})
+
+	t.Run("not listed", func(t *testing.T) {
+		const index = `
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+{{ range pages "" }}{{ .Permalink }} {{ end }}
+`
+		dst := buildSite(t, fmt.Sprintf(ar, "Web Development")+index, &Config{SearchIndex: true})
+		for _, name := range []string{"index.html", "search-index.json", "feed.xml"} {
+			if got := readFile(t, filepath.Join(dst, name)); strings.Contains(got, "/tags/") {
+				t.Errorf("%s lists tag pages:\n%s", name, got)
+			}
+		}
+	})
+
+	t.Run("slug collision", func(t *testing.T) {
+		c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf}
+		testutil.ExtractTxtar(t, txtar.Parse([]byte(fmt.Sprintf(ar, "web development"))), c.Src)
+		err := Build(c)
+		if err == nil || !strings.Contains(err.Error(), `same slug "web-development"`) {
+			t.Fatalf("want slug collision error, got %v", err)
+		}
+	})
+}
+
+func TestPageOrder(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/a-undated.md --
+{
+  "title": "A undated",
+  "template": "layout",
+  "permalink": "/a"
+}
+-- pages/b-old.md --
+{
+  "title": "B old",
+  "template": "layout",
+  "permalink": "/b",
+  "date": "2023-01-01"
+}
+-- pages/c-undated.md --
+{
+  "title": "C undated",
+  "template": "layout",
+  "permalink": "/c"
+}
+-- pages/d-new.md --
+{
+  "title": "D new",
+  "template": "layout",
+  "permalink": "/d",
+  "date": "2023-03-01"
+}
+-- pages/e-middle.md --
+{
+  "title": "E middle",
+  "template": "layout",
+  "permalink": "/e",
+  "date": "2023-02-01"
+}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/",
+  "type": "index"
+}
+
+{{ range pages "page" }}{{ .Title }};{{ end }}
+`
+	want := "D new;E middle;B old;A undated;C undated;"
+	for range 5 {
+		dst := buildSite(t, ar, &Config{})
+		testutil.AssertEqual(t, strings.TrimSpace(readFile(t, filepath.Join(dst, "index.html"))), want)
+	}
+}
+
+func TestScheduledPosts(t *testing.T) {
+	next := time.Now().AddDate(1, 0, 0).Format("2006-01-02")
+	ar := `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/scheduled.md --
+{
+  "title": "Scheduled",
+  "template": "layout",
+  "permalink": "/scheduled",
+  "type": "post",
+  "date": "` + next + `"
+}
+
+Coming soon.
+`
+	cases := map[string]struct {
+		prod bool
+		want bool
+	}{
+		"dev":  {prod: false, want: true},
+		"prod": {prod: true, want: false},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dst := buildSite(t, ar, &Config{Prod: tc.prod})
+			_, err := os.Stat(filepath.Join(dst, "scheduled.html"))
+			if got := err == nil; got != tc.want {
+				t.Errorf("scheduled.html exists = %v, want %v", got, tc.want)
+			}
+			if got := strings.Contains(readFile(t, filepath.Join(dst, "feed.xml")), "Coming soon"); got != tc.want {
+				t.Errorf("feed contains the post = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOpenGraph(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ openGraph . }}
+-- pages/post.md --
+{
+  "title": "Hello & welcome",
+  "template": "layout",
+  "permalink": "/hello",
+  "type": "post",
+  "summary": "A \"quoted\" summary.",
+  "image": "/images/hello.png"
+}
+-- pages/about.md --
+{
+  "title": "About",
+  "template": "layout",
+  "permalink": "/about"
+}
+`
+	dst := buildSite(t, ar, &Config{})
+
+	testutil.AssertEqual(t, readFile(t, filepath.Join(dst, "hello.html")), `<meta property="og:title" content="Hello &amp; welcome" />
+<meta property="og:url" content="https://astrophena.name/hello" />
+<meta property="og:type" content="article" />
+<meta property="og:description" content="A &#34;quoted&#34; summary." />
+<meta property="og:image" content="https://astrophena.name/images/hello.png" />
+<meta name="twitter:card" content="summary_large_image" />
+`)
+	testutil.AssertEqual(t, readFile(t, filepath.Join(dst, "about.html")), `<meta property="og:title" content="About" />
+<meta property="og:url" content="https://astrophena.name/about" />
+<meta property="og:type" content="website" />
+<meta name="twitter:card" content="summary" />
+`)
+}
+
+func TestPageBuildIdempotent(t *testing.T) {
+	c := &Config{Logf: t.Logf, PrefixHeadingIDs: true, LazyImages: true}
+	c.setDefaults()
+	b := newBuildContext(c)
+	tpl, err := template.New("layout").Funcs(b.funcs).Parse("<title>{{ .Title }}</title>\n{{ content . }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Page{path: "hello.md", b: b}
+	if err := p.parse(strings.NewReader(`{
+  "title": "Hello",
+  "template": "layout",
+  "permalink": "/hello"
+}
+
+Intro of {{ .Title }}.
+
+<!-- more -->
+
+## Details
+
+![Cat](/cat.png)
+`)); err != nil {
+		t.Fatal(err)
+	}
+	source := string(p.contents)
+
+	build := func() string {
+		var buf bytes.Buffer
+		if err := p.build(b, tpl, &buf); err != nil {
+			t.Fatal(err)
+		}
+		// Force rendering again on the next build.
+		p.rendered = false
+		return buf.String()
+	}
+	first, second := build(), build()
+	testutil.AssertEqual(t, second, first)
+	testutil.AssertEqual(t, string(p.contents), source)
+}
+
+func TestIncrementalBuild(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/a.md --
+{
+  "title": "A",
+  "template": "layout",
+  "permalink": "/a"
+}
+
+A.
+-- pages/b.md --
+{
+  "title": "B",
+  "template": "layout",
+  "permalink": "/b"
+}
+
+B.
+-- pages/c.md --
+{
+  "title": "C",
+  "template": "layout",
+  "permalink": "/c"
+}
+
+C.
+-- pages/d.html --
+{
+  "title": "D",
+  "template": "layout",
+  "permalink": "/d"
+}
+
+<p>{{ .Title }}</p>
+`
+	c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf}
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+	state := new(outputState)
+	if _, _, err := build(c, false, state); err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertEqual(t, len(state.rendered), 4)
+
+	// Make all files look old, so rewritten ones are easy to tell.
+	old := time.Now().Add(-time.Hour)
+	mtimes := make(map[string]time.Time)
+	for name := range state.hashes {
+		p := filepath.Join(c.Dst, filepath.FromSlash(name))
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+		mtimes[name] = old
+	}
+
+	// Change one page and delete another.
+	b := filepath.Join(c.Src, "pages", "b.md")
+	if err := os.WriteFile(b, []byte(strings.Replace(readFile(t, b), "B.", "B, changed.", 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(c.Src, "pages", "c.md")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := build(c, false, state); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mtime := range mtimes {
+		fi, err := os.Stat(filepath.Join(c.Dst, filepath.FromSlash(name)))
+		if name == "c.html" {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("c.html of the deleted page wasn't removed: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if advanced := fi.ModTime().After(mtime); advanced != (name == "b.html") {
+			t.Errorf("%s: modification time advanced = %v", name, advanced)
+		}
+	}
+	if got := readFile(t, filepath.Join(c.Dst, "b.html")); !strings.Contains(got, "B, changed.") {
+		t.Errorf("b.html wasn't updated:\n%s", got)
+	}
+
+	// Only the changed page and the page with template actions, that can
+	// depend on other pages, were rendered again.
+	var rendered []string
+	for _, path := range state.rendered {
+		rendered = append(rendered, filepath.Base(path))
+	}
+	slices.Sort(rendered)
+	testutil.AssertEqual(t, rendered, []string{"b.md", "d.html"})
+	if got := readFile(t, filepath.Join(c.Dst, "a.html")); !strings.Contains(got, "<p>A.</p>") {
+		t.Errorf("a.html lost its reused contents:\n%s", got)
+	}
+}
+
+func TestIncrementalBuildAfterFailure(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/a.md --
+{
+  "title": "A",
+  "template": "layout",
+  "permalink": "/a"
+}
+
+v1
+-- pages/b.md --
+{
+  "title": "B",
+  "template": "layout",
+  "permalink": "/b"
+}
+
+B.
+`
+	c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf}
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+	state := new(outputState)
+	if _, _, err := build(c, false, state); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := filepath.Join(c.Src, "pages", "a.md"), filepath.Join(c.Src, "pages", "b.md")
+	origA, origB := readFile(t, a), readFile(t, b)
+	write := func(name, contents string) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A is rewritten before B fails the build.
+	write(a, strings.Replace(origA, "v1", "v2", 1))
+	write(b, strings.Replace(origB, `"layout"`, `"missing"`, 1))
+	if _, _, err := build(c, false, state); err == nil {
+		t.Fatal("build with a missing template succeeded")
+	}
+	if got := readFile(t, filepath.Join(c.Dst, "a.html")); !strings.Contains(got, "v2") {
+		t.Fatalf("a.html wasn't rewritten before the failure:\n%s", got)
+	}
+
+	// Reverting both must bring back the original output.
+	write(a, origA)
+	write(b, origB)
+	if _, _, err := build(c, false, state); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(c.Dst, "a.html")); !strings.Contains(got, "v1") {
+		t.Errorf("a.html is stale after reverting:\n%s", got)
+	}
+}
+
+func TestLiveReload(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<html><body>{{ content . }}</body></html>
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<p>Before</p>
+`
+	src := t.TempDir()
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), src)
+	addr := startServer(t, &Config{
+		Src:      src,
+		Dst:      t.TempDir(),
+		Logf:     t.Logf,
+		SkipFeed: true,
+	})
+
+	res, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<script>new EventSource("/_reload")`; !strings.Contains(string(body), want) {
+		t.Fatalf("page doesn't contain reload script %s:\n%s", want, body)
+	}
+	res, err = http.Get("http://" + addr + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only HTML is modified.
+	testutil.AssertEqual(t, string(body), "test\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/_reload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Body.Close()
+	testutil.AssertEqual(t, events.Header.Get("Content-Type"), "text/event-stream")
+
+	index := filepath.Join(src, "pages", "index.html")
+	updated := strings.Replace(readFile(t, index), "Before", "After", 1)
+	if err := os.WriteFile(index, []byte(updated), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(events.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("no reload event received: %v", err)
+	}
+	testutil.AssertEqual(t, line, "event: reload\n")
+}
+
+func TestPrecompress(t *testing.T) {
+	const ar = `
+-- static/css/main.css --
+body { color: red; }
+-- static/robots.txt --
+User-agent: *
+-- static/image.png --
+not really a PNG
+-- templates/layout.html --
+<html><body>{{ content . }}</body></html>
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+Hello, world!
+`
+	decompress := map[string]func(io.Reader) (io.Reader, error){
+		".gz": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		".br": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	}
+
+	dst := buildSite(t, ar, &Config{Prod: true, Precompress: true})
+	for _, name := range []string{"index.html", "feed.xml", "feed.json", "css/main.css", "robots.txt"} {
+		orig := readFile(t, filepath.Join(dst, name))
+		for ext, fn := range decompress {
+			f, err := os.Open(filepath.Join(dst, name+ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := fn(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			f.Close()
+			if err != nil {
+				t.Fatalf("%s%s: %v", name, ext, err)
+			}
+			testutil.AssertEqual(t, string(got), orig)
+		}
+	}
+	for _, name := range []string{"image.png.gz", "image.png.br", "index.html.gz.gz"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s shouldn't exist, got %v", name, err)
+		}
+	}
+
+	// Development builds are not compressed.
+	dst = buildSite(t, ar, &Config{Precompress: true})
+	if _, err := os.Stat(filepath.Join(dst, "index.html.gz")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("index.html.gz shouldn't exist in development build, got %v", err)
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/plain.html --
+{{ content . }}
+-- pages/security.html --
+{
+  "title": "Security",
+  "template": "plain",
+  "permalink": "/.well-known/security.txt",
+  "output": "%s"
+}
+
+Contact: mailto:security@example.com
+`
+	t.Run("exact path", func(t *testing.T) {
+		dst := buildSite(t, fmt.Sprintf(ar, "/.well-known/security.txt"), &Config{})
+		got := readFile(t, filepath.Join(dst, ".well-known", "security.txt"))
+		testutil.AssertEqual(t, strings.TrimSpace(got), "Contact: mailto:security@example.com")
+	})
+
+	for _, output := range []string{"../outside.txt", "/.well-known/../../outside.txt", "/"} {
+		t.Run("invalid "+output, func(t *testing.T) {
+			c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf}
+			testutil.ExtractTxtar(t, txtar.Parse([]byte(fmt.Sprintf(ar, output))), c.Src)
+			err := Build(c)
+			if !errors.Is(err, errOutputInvalid) {
+				t.Fatalf("want errOutputInvalid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInferFrontmatter(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/main.html --
+<title>{{ .Title }}</title>
+{{ content . }}
+-- pages/notes/imported-note.md --
+# Imported *note*
+
+Some text.
+-- pages/notes/index.md --
+# Notes
+
+All notes.
+-- pages/untitled.md --
+Just text.
+`
+	t.Run("inferred", func(t *testing.T) {
+		ar := strings.TrimSuffix(ar, "-- pages/untitled.md --\nJust text.\n")
+		dst := buildSite(t, ar, &Config{InferFrontmatter: true})
+		testutil.AssertEqual(t, readFile(t, filepath.Join(dst, "notes", "imported-note.html")), "<title>Imported note</title>\n<p>Some text.</p>\n")
+		testutil.AssertEqual(t, readFile(t, filepath.Join(dst, "notes.html")), "<title>Notes</title>\n<p>All notes.</p>\n")
+	})
+
+	cases := map[string]struct {
+		infer   bool
+		wantErr string
+	}{
+		"disabled":           {wantErr: "missing frontmatter"},
+		"no leading heading": {infer: true, wantErr: "no leading heading"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf, InferFrontmatter: tc.infer}
+			testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+			err := Build(c)
+			if !errors.Is(err, errFrontmatterMissing) || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBuildResult(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+-- pages/post.md --
+{
+  "title": "Post",
+  "template": "layout",
+  "permalink": "/blog/post",
+  "type": "post",
+  "date": "2024-01-02"
+}
+-- pages/security.html --
+{
+  "title": "Security",
+  "template": "layout",
+  "permalink": "/.well-known/security.txt",
+  "output": "/.well-known/security.txt"
+}
+`
+	c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf}
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+	res, err := BuildResult(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2024, time.January, 2, 0, 0, 0, 0, time.UTC)
+	testutil.AssertEqual(t, res.Pages, []*BuiltPage{
+		{Title: "Post", Permalink: "/blog/post", Path: "blog/post.html", Type: "post", Date: &date},
+		{Title: "Index", Permalink: "/", Path: "index.html", Type: "page"},
+		{Title: "Security", Permalink: "/.well-known/security.txt", Path: ".well-known/security.txt", Type: "page"},
+	})
+	for _, p := range res.Pages {
+		if _, err := os.Stat(filepath.Join(c.Dst, filepath.FromSlash(p.Path))); err != nil {
+			t.Errorf("built page %s: %v", p.Permalink, err)
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	testutil.RunGolden(t, "testdata/search/*.txtar", func(t *testing.T, match string) []byte {
+		ar, err := txtar.ParseFile(match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Config{Src: t.TempDir(), Dst: t.TempDir(), Logf: t.Logf, SearchIndex: true}
+		testutil.ExtractTxtar(t, ar, c.Src)
+		if err := Build(c); err != nil {
+			t.Fatal(err)
+		}
+		return []byte(readFile(t, filepath.Join(c.Dst, "search-index.json")))
+	}, *update)
+}
+
+func TestExcerptAndWordCount(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ excerpt . }}|{{ wordCount . }}
+-- pages/summary.md --
+{
+  "title": "Summary",
+  "template": "layout",
+  "permalink": "/summary",
+  "summary": "Written <by> hand."
+}
+
+First paragraph.
+-- pages/paragraphs.md --
+{
+  "title": "Paragraphs",
+  "template": "layout",
+  "permalink": "/paragraphs"
+}
+
+## Heading
+
+First *paragraph* here.
+
+Second paragraph.
+-- pages/code.md --
+{
+  "title": "Code",
+  "template": "layout",
+  "permalink": "/code"
+}
+
+    <p>not a paragraph</p>
+-- pages/pre.html --
+{
+  "title": "Pre",
+  "template": "layout",
+  "permalink": "/pre"
+}
+
+<pre><p>preformatted</p></pre>
+<p>Real one.</p>
+-- pages/marker.md --
+{
+  "title": "Marker",
+  "template": "layout",
+  "permalink": "/marker",
+  "summary": "Written by hand."
+}
+
+Intro *text*.
+
+<!-- more -->
+
+Rest.
+`
+	dst := buildSite(t, ar, &Config{})
+
+	cases := map[string]string{
+		"summary.html":    "Written &lt;by&gt; hand.|2",
+		"paragraphs.html": "First <em>paragraph</em> here.|6",
+		"code.html":       "|3",
+		"pre.html":        "Real one.|3",
+		"marker.html":     "<p>Intro <em>text</em>.</p>|3",
+	}
+	for file, want := range cases {
+		testutil.AssertEqual(t, strings.TrimSpace(readFile(t, filepath.Join(dst, file))), want)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	ar, err := os.ReadFile(filepath.Join("testdata", "pagination.txtar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := buildSite(t, string(ar), &Config{})
+	for _, name := range []string{"blog.html", "blog/page/2.html", "blog/page/3.html"} {
+		if _, err := os.Stat(filepath.Join(dst, filepath.FromSlash(name))); err != nil {
+			t.Errorf("listing page not written: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "blog", "page", "4.html")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("extra listing page written: %v", err)
+	}
+}
+
+func TestRedirectPages(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ range pages "" }}{{ .Permalink }} {{ end }}
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+-- pages/new.md --
+{
+  "title": "New post",
+  "template": "layout",
+  "permalink": "/new",
+  "type": "post"
+}
+-- pages/old.md --
+{
+  "title": "Old post",
+  "permalink": "/old",
+  "type": "post",
+  "redirect_to": "/new"
+}
+`
+	for _, tc := range []struct {
+		prod bool
+		want string
+	}{
+		{prod: false, want: "/new"},
+		{prod: true, want: "https://astrophena.name/new"},
+	} {
+		t.Run(fmt.Sprintf("prod=%v", tc.prod), func(t *testing.T) {
+			dst := buildSite(t, ar, &Config{Prod: tc.prod})
+
+			stub := readFile(t, filepath.Join(dst, "old.html"))
+			for _, want := range []string{
+				`<meta http-equiv="refresh" content="0; url=` + tc.want + `" />`,
+				`<link rel="canonical" href="` + tc.want + `" />`,
+			} {
+				if !strings.Contains(stub, want) {
+					t.Errorf("redirect stub doesn't contain %q:\n%s", want, stub)
+				}
+			}
+
+			if got := readFile(t, filepath.Join(dst, "index.html")); strings.Contains(got, "/old") {
+				t.Errorf("redirect page is listed: %q", got)
+			}
+			if tc.prod {
+				if feed := readFile(t, filepath.Join(dst, "feed.xml")); strings.Contains(feed, "Old post") {
+					t.Errorf("redirect page is in feed:\n%s", feed)
+				}
+			}
+		})
+	}
+
+	t.Run("result and Open Graph images", func(t *testing.T) {
+		c := &Config{
+			Src:              t.TempDir(),
+			Dst:              t.TempDir(),
+			Logf:             t.Logf,
+			GenerateOGImages: true,
+		}
+		testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), c.Src)
+		res, err := BuildResult(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range res.Pages {
+			if p.Permalink == "/old" {
+				t.Errorf("redirect page is in build result: %+v", p)
+			}
+		}
+		images, err := filepath.Glob(filepath.Join(c.Dst, "og", "*.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(images) != 2 {
+			t.Errorf("want Open Graph images only for index and new post, got %v", images)
+		}
+	})
+}
+
+func TestMarkdownOptions(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+Say "hello".
+`
+	for _, tc := range []struct {
+		name string
+		opts MarkdownOptions
+		want string
+	}{
+		{name: "default", want: "<p>Say “hello”.</p>"},
+		{name: "no smart quotes", opts: MarkdownOptions{DisableSmartQuote: true}, want: "<p>Say &quot;hello&quot;.</p>"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := buildSite(t, ar, &Config{Markdown: tc.opts})
+			if got := strings.TrimSpace(readFile(t, filepath.Join(dst, "index.html"))); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEmojiShortcodes(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ content . }}
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+Ship it :shipit: :rocket: :party-parrot: :nope: ` + "`:shipit:`" + `
+`
+	dst := buildSite(t, ar, &Config{Emoji: map[string]string{
+		"shipit":       "🐿️",
+		"party-parrot": "/images/parrot.gif",
+	}})
+	got := strings.TrimSpace(readFile(t, filepath.Join(dst, "index.html")))
+	const want = `<p>Ship it 🐿️ 🚀 <img class="emoji" src="/images/parrot.gif" alt=":party-parrot:"> :nope: <code>:shipit:</code></p>`
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDraftBanner(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+{{ if isDraft . }}<meta name="robots" content="noindex">{{ end }}{{ content . }}
+-- pages/index.md --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+Published.
+-- pages/draft.md --
+{
+  "title": "Draft",
+  "template": "layout",
+  "permalink": "/draft",
+  "draft": true
+}
+
+Not yet.
+-- pages/scheduled.md --
+{
+  "title": "Scheduled",
+  "template": "layout",
+  "permalink": "/scheduled",
+  "date": "2999-01-01"
+}
+
+Later.
+`
+	const noindex = `<meta name="robots" content="noindex">`
+
+	dst := buildSite(t, ar, &Config{})
+	for _, name := range []string{"draft.html", "scheduled.html"} {
+		if got := readFile(t, filepath.Join(dst, name)); !strings.Contains(got, noindex) {
+			t.Errorf("%s has no noindex meta tag in development:\n%s", name, got)
+		}
+	}
+	if got := readFile(t, filepath.Join(dst, "index.html")); strings.Contains(got, noindex) {
+		t.Errorf("published page has noindex meta tag:\n%s", got)
+	}
+
+	dst = buildSite(t, ar, &Config{Prod: true})
+	if _, err := os.Stat(filepath.Join(dst, "draft.html")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("draft is built in production: %v", err)
+	}
+}
+
+func TestServeWatchesNewDirs(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<html><body>{{ content . }}</body></html>
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<p>Index</p>
+`
+	src := t.TempDir()
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), src)
+	addr := startServer(t, &Config{
+		Src:      src,
+		Dst:      t.TempDir(),
+		Logf:     t.Logf,
+		SkipFeed: true,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/_reload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Body.Close()
+	r := bufio.NewReader(events.Body)
+
+	// Creating a directory triggers a rebuild, after which it is watched.
+	section := filepath.Join(src, "pages", "section")
+	if err := os.Mkdir(section, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatalf("no reload event received after creating a directory: %v", err)
+	}
+
+	const page = `{
+  "title": "New",
+  "template": "layout",
+  "permalink": "/section/new"
+}
+
+<p>New</p>
+`
+	if err := os.WriteFile(filepath.Join(section, "new.html"), []byte(page), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatalf("no rebuild after creating a page in a new directory: %v", err)
+		}
+		res, err := http.Get("http://" + addr + "/section/new")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			break
+		}
+	}
+}
+
+func TestServeBuildErrorOverlay(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<html><body>{{ content . }}</body></html>
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<p>Index</p>
+`
+	src := t.TempDir()
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), src)
+	addr := startServer(t, &Config{
+		Src:      src,
+		Dst:      t.TempDir(),
+		Logf:     t.Logf,
+		SkipFeed: true,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/_reload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Body.Close()
+	r := bufio.NewReader(events.Body)
+
+	get := func() (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "text/html")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(body)
+	}
+	// update writes contents to the index page and waits until a rebuild
+	// makes it served with status.
+	index := filepath.Join(src, "pages", "index.html")
+	orig := readFile(t, index)
+	update := func(contents string, status int) string {
+		t.Helper()
+		if err := os.WriteFile(index, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				t.Fatalf("no reload event received: %v", err)
+			}
+			if got, body := get(); got == status {
+				return body
+			}
+		}
+	}
+
+	body := update(strings.Replace(orig, "<p>Index</p>", "{{ .Broken", 1), http.StatusInternalServerError)
+	if !strings.Contains(body, "Failed to build the site") {
+		t.Fatalf("build error overlay is not served:\n%s", body)
+	}
+
+	body = update(orig, http.StatusOK)
+	if !strings.Contains(body, "<p>Index</p>") {
+		t.Fatalf("page is not served after fixing the build:\n%s", body)
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	const ar = `
+-- static/test --
+test
+-- templates/layout.html --
+<html><body>{{ content . }}</body></html>
+-- pages/index.html --
+{
+  "title": "Index",
+  "template": "layout",
+  "permalink": "/"
+}
+
+<p>Index</p>
+`
+	src := t.TempDir()
+	testutil.ExtractTxtar(t, txtar.Parse([]byte(ar)), src)
+	addr := startServer(t, &Config{
+		Src:      src,
+		Dst:      t.TempDir(),
+		Logf:     t.Logf,
+		SkipFeed: true,
+		ServeTLS: true,
+	})
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	res, err := client.Get("https://" + addr + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertEqual(t, res.StatusCode, http.StatusOK)
+	testutil.AssertEqual(t, string(body), "test\n")
+	if res.TLS == nil {
+		t.Fatal("response is not served over TLS")
+	}
+	cert := res.TLS.PeerCertificates[0]
+	if err := cert.VerifyHostname("localhost"); err != nil {
+		t.Errorf("self-signed certificate is not for localhost: %v", err)
+	}
+	if time.Until(cert.NotAfter) < 30*24*time.Hour {
+		t.Errorf("self-signed certificate expires too soon, at %v", cert.NotAfter)
+	}
+}
+
+func TestServeTLSValidation(t *testing.T) {
+	cases := map[string]*Config{
+		"cert without key": {ServeTLS: true, TLSCertFile: "cert.pem"},
+		"key without cert": {ServeTLS: true, TLSKeyFile: "key.pem"},
+		"without ServeTLS": {TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := c.validate(); err == nil {
+				t.Fatal("want error, got nil")
+			}
+		})
+	}
+	if err := (&Config{ServeTLS: true, TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}).validate(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+}
+
+func TestDebouncer(t *testing.T) {
+	var calls atomic.Int32
+	done := make(chan struct{}, 10)
+	deb := newDebouncer(20*time.Millisecond, func() {
+		calls.Add(1)
+		done <- struct{}{}
+	})
+	defer deb.stop()
+
+	for range 10 {
+		deb.Do()
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+	// Give extra calls, if any, a chance to fire.
+	time.Sleep(100 * time.Millisecond)
+	testutil.AssertEqual(t, calls.Load(), int32(1))
+}
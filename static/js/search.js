@@ -0,0 +1,42 @@
+// Filters packages on the go.astrophena.name index page using index.json.
+window.addEventListener('load', async function () {
+  const input = document.getElementById('search');
+  const results = document.getElementById('search-results');
+  if (!input || !results) {
+    return;
+  }
+
+  let pkgs;
+  try {
+    const resp = await fetch('/index.json');
+    pkgs = await resp.json();
+  } catch (error) {
+    console.error('Loading search index failed: ' + error);
+    return;
+  }
+
+  input.hidden = false;
+  input.addEventListener('input', function () {
+    const query = input.value.trim().toLowerCase();
+    results.replaceChildren();
+    results.hidden = query === '';
+    if (query === '') {
+      return;
+    }
+
+    for (const pkg of pkgs) {
+      if (!pkg.import_path.toLowerCase().includes(query) && !pkg.synopsis.toLowerCase().includes(query)) {
+        continue;
+      }
+      const li = document.createElement('li');
+      const a = document.createElement('a');
+      a.href = pkg.url;
+      a.textContent = pkg.import_path;
+      li.append(a);
+      if (pkg.synopsis) {
+        li.append(' — ' + pkg.synopsis);
+      }
+      results.append(li);
+    }
+  });
+}, false);
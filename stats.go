@@ -0,0 +1,76 @@
+//usr/bin/env go run $0 $@; exit $?
+
+// © 2022 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the ISC
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"go.astrophena.name/site"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	var (
+		draftsFlag = flag.Bool("drafts", false, "Include drafts.")
+		jsonFlag   = flag.Bool("json", false, "Print statistics in JSON format.")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: ./stats.go [flags]\n")
+		fmt.Fprintf(os.Stderr, "Available flags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(wd, "go.mod")); os.IsNotExist(err) {
+		log.Fatal("Are you at repo root?")
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	st, err := site.ComputeStats(&site.Config{
+		Src:  ".",
+		Prod: !*draftsFlag,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(st); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	fmt.Printf("Pages: %d\n", st.Pages)
+	fmt.Printf("Posts: %d", st.Posts)
+	if st.FirstPost != nil && st.LastPost != nil {
+		const layout = "January 2, 2006"
+		fmt.Printf(" (from %s to %s)", st.FirstPost.Format(layout), st.LastPost.Format(layout))
+	}
+	fmt.Println()
+	fmt.Printf("Words: %d\n", st.Words)
+	for _, typ := range slices.Sorted(maps.Keys(st.WordsByType)) {
+		fmt.Printf("  %s: %d\n", typ, st.WordsByType[typ])
+	}
+}
@@ -7,12 +7,16 @@ package vanity
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
 	"embed"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
@@ -22,31 +26,71 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"go.astrophena.name/base/logger"
 	"go.astrophena.name/base/request"
 	"go.astrophena.name/site"
+
+	"golang.org/x/sync/errgroup"
 )
 
 // Config represents a build configuration.
 type Config struct {
 	// Dir is a directory where the generated site will be stored.
 	Dir string
+	// Provider is a code hosting service where repositories are discovered:
+	// "github" (default) or "gitlab".
+	Provider string
 	// GitHubToken is a token for accessing the GitHub API.
 	GitHubToken string
+	// GitLabToken is a token for accessing the GitLab API, used when Provider
+	// is "gitlab".
+	GitLabToken string
+	// ReposFile is a path to a JSON file with repositories in the format of
+	// GitHub API response. If set, repositories are read from it instead of
+	// GitHub API, and Go modules are detected after cloning, so the build
+	// doesn't make any GitHub API requests.
+	ReposFile string
 	// ImportRoot is a root import path for the Go packages.
 	ImportRoot string
 	// Logf is a logger to use. If nil, log.Printf is used.
 	Logf logger.Logf
 	// HTTPClient is a HTTP client for making requests.
 	HTTPClient *http.Client
+	// SortBy determines the order of repositories on the index page: "pushed"
+	// sorts by last push date, "stars" by star count, both descending. If
+	// empty, the order of GitHub API response is used.
+	SortBy string
+	// PinnedRepos is a list of repository names that are shown first on the
+	// index page, in the given order.
+	PinnedRepos []string
+	// CacheDir is a directory where provider API responses are cached between
+	// builds, optional. Cached responses are revalidated with conditional
+	// requests, so unchanged ones are read from disk.
+	CacheDir string
+	// Branches maps repository names to branches that are cloned to generate
+	// documentation instead of the default branch, optional.
+	Branches map[string]string
+	// IncludeArchived makes archived repositories listed on the index page,
+	// marked as archived. By default they are left out.
+	IncludeArchived bool
+	// Concurrency limits how many repositories are cloned and documented in
+	// parallel. Zero means runtime.NumCPU().
+	Concurrency int
 }
 
 type buildContext struct {
-	c   *Config
-	tpl *template.Template
+	c          *Config
+	tpl        *template.Template
+	provider   provider     // discovers repositories
+	token      string       // API token of the provider
+	httpClient *http.Client // used for API requests
 }
 
 //go:embed templates/*.html
@@ -60,44 +104,55 @@ func Build(ctx context.Context, c *Config) error {
 	if c.Logf == nil {
 		c.Logf = logger.Logf(log.Printf)
 	}
-	b := &buildContext{c: c}
-
-	// Initialize templates.
-	var err error
-	b.tpl, err = template.New("vanity").Funcs(template.FuncMap{
-		"contains":   strings.Contains,
-		"hasOnePkg":  b.hasOnePkg,
-		"importRoot": func() string { return c.ImportRoot },
-	}).ParseFS(tplFS, "templates/*.html")
+	b, err := newBuildContext(c)
 	if err != nil {
 		return err
 	}
 
-	// Obtain needed repositories from GitHub API.
-	allRepos, err := makeRequest[[]*repo](ctx, c, "https://api.github.com/user/repos")
-	if err != nil {
-		return err
+	// Obtain needed repositories from provider API or a local file.
+	var allRepos []*repo
+	if c.ReposFile != "" {
+		b, err := os.ReadFile(c.ReposFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &allRepos); err != nil {
+			return fmt.Errorf("parsing %s: %w", c.ReposFile, err)
+		}
+	} else {
+		allRepos, err = b.provider.listRepos(ctx, b)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Filter only Go modules.
 	var repos []*repo
 	for _, repo := range allRepos {
-		if repo.Fork || repo.Name == "vanity" {
+		if repo.Fork || repo.Name == "vanity" || (repo.Archived && !c.IncludeArchived) {
+			continue
+		}
+
+		// Repos read from file are checked for go.mod after cloning.
+		if c.ReposFile != "" {
+			repos = append(repos, repo)
 			continue
 		}
 
-		files, err := makeRequest[[]file](ctx, c, repo.URL+"/contents")
+		isGo, err := b.provider.isGoModule(ctx, b, repo)
 		if err != nil {
 			return err
 		}
-		for _, f := range files {
-			if f.Path == "go.mod" {
-				repos = append(repos, repo)
-				break
-			}
+		if isGo {
+			repos = append(repos, repo)
 		}
 	}
 
+	if err := sortRepos(repos, c.SortBy); err != nil {
+		return err
+	}
+	repos = pinRepos(c, repos)
+
 	// Clean up after previous build.
 	if _, err := os.Stat(c.Dir); err == nil {
 		if err := os.RemoveAll(c.Dir); err != nil {
@@ -129,15 +184,20 @@ func Build(ctx context.Context, c *Config) error {
 	// Compile the doc2go binary.
 	c.Logf("Building doc2go.")
 	doc2go := filepath.Join(tmpdir, "doc2go")
-	install := exec.Command("go", "install", "go.abhg.dev/doc2go")
+	install := exec.CommandContext(ctx, "go", "install", "go.abhg.dev/doc2go")
 	install.Env = append(os.Environ(), "GOBIN="+filepath.Join(tmpdir))
 	install.Stderr = c.Logf
 	if err := install.Run(); err != nil {
 		return err
 	}
 
-	for _, repo := range repos {
+	// Clone repositories, list their packages and generate docs in parallel.
+	isGo := make([]bool, len(repos))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(cmp.Or(c.Concurrency, runtime.NumCPU()))
+	for i, repo := range repos {
 		if repo.Private {
+			isGo[i] = true
 			// For private repos, we create a single virtual package.
 			repo.Pkgs = []*pkg{
 				&pkg{
@@ -153,56 +213,31 @@ func Build(ctx context.Context, c *Config) error {
 			repo.Description += "."
 		}
 
-		c.Logf("Cloning repository %s.", repo.Name)
-		repo.Dir = filepath.Join(reposDir, repo.Name)
-		clone := exec.Command("git", "clone", "--depth=1", repo.CloneURL, repo.Dir)
-		clone.Stderr = c.Logf
-		if err := clone.Run(); err != nil {
+		g.Go(func() error {
+			var err error
+			isGo[i], err = b.prepareRepo(gctx, repo, reposDir, doc2go)
 			return err
-		}
-
-		c.Logf("Running \"go list\" for %s.", repo.Name)
-		var obuf, errbuf bytes.Buffer
-		list := exec.Command("go", "list", "-json", "./...")
-		list.Dir = repo.Dir
-		list.Stdout = &obuf
-		list.Stderr = &errbuf
-		if err := list.Run(); err != nil {
-			return fmt.Errorf("go list failed for repo %s: %v (it returned %q)", repo.Name, err, errbuf.String())
-		}
-
-		dec := json.NewDecoder(&obuf)
-		for dec.More() {
-			p := new(pkg)
-			if err := dec.Decode(p); err != nil {
-				return err
-			}
-			p.Repo = repo
-			repo.Pkgs = append(repo.Pkgs, p)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	goRepos := repos[:0]
+	for i, repo := range repos {
+		if isGo[i] {
+			goRepos = append(goRepos, repo)
 		}
 	}
+	repos = goRepos
 
 	// Build repo and package pages.
 	for _, repo := range repos {
-		if repo.Dir != "" {
-			c.Logf("Generating docs for %s.", repo.Name)
-			git := exec.Command("git", "rev-parse", "--short", "HEAD")
-			git.Dir = repo.Dir
-			commitb, err := git.Output()
-			if err != nil {
-				return err
-			}
-			commitn := string(commitb)
-			repo.Commit = strings.TrimSuffix(commitn, "\n")
-
-			if err := repo.generateDoc(c, doc2go); err != nil {
-				return err
-			}
-		}
-
 		for _, pkg := range repo.Pkgs {
-			if strings.Contains(pkg.BasePath, "internal") {
-				continue
+			// Internal packages get a stub page, so the go command finds
+			// the go-import meta tag for nested modules inside them.
+			tmpl := "pkg"
+			if pkg.isInternal() {
+				tmpl = "internal"
 			}
 
 			if err := b.buildPage(filepath.Join(siteDir, "pages", pkg.BasePath+".html"), &site.Page{
@@ -212,7 +247,7 @@ func Build(ctx context.Context, c *Config) error {
 				Permalink:   "/" + pkg.BasePath,
 				MetaTags:    metaTagsForRepo(c, repo),
 				ContentOnly: repo.Private,
-			}, "pkg", pkg); err != nil {
+			}, tmpl, pkg); err != nil {
 				return err
 			}
 		}
@@ -243,7 +278,8 @@ func Build(ctx context.Context, c *Config) error {
 
 	// Generate CSS for syntax highlighting.
 
-	hcss, err := exec.Command(
+	hcss, err := exec.CommandContext(
+		ctx,
 		doc2go,
 		"-highlight", highlightTheme,
 		"-highlight-print-css",
@@ -258,6 +294,11 @@ func Build(ctx context.Context, c *Config) error {
 		return err
 	}
 
+	// Generate search index.
+	if err := writeIndex(filepath.Join(siteDir, "static", "index.json"), repos); err != nil {
+		return err
+	}
+
 	// Finally, build.
 	return site.Build(&site.Config{
 		Title: "Go Packages",
@@ -273,6 +314,108 @@ func Build(ctx context.Context, c *Config) error {
 	})
 }
 
+// prepareRepo clones repo into reposDir and, if it's a Go module, lists its
+// packages and generates their docs. It reports whether repo is a Go module.
+func (b *buildContext) prepareRepo(ctx context.Context, repo *repo, reposDir, doc2go string) (bool, error) {
+	c := b.c
+
+	c.Logf("Cloning repository %s.", repo.Name)
+	repo.Dir = filepath.Join(reposDir, repo.Name)
+	args := []string{"clone", "--depth=1"}
+	if branch := c.Branches[repo.Name]; branch != "" {
+		c.Logf("Using branch %s of %s.", branch, repo.Name)
+		args = append(args, "--branch", branch)
+	}
+	clone := exec.CommandContext(ctx, "git", append(args, repo.CloneURL, repo.Dir)...)
+	clone.Stderr = c.Logf
+	if err := clone.Run(); err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(filepath.Join(repo.Dir, "go.mod")); errors.Is(err, fs.ErrNotExist) {
+		c.Logf("Skipping %s: not a Go module.", repo.Name)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	c.Logf("Running \"go list\" for %s.", repo.Name)
+	if err := repo.listPackages(ctx); err != nil {
+		return false, err
+	}
+
+	c.Logf("Generating docs for %s.", repo.Name)
+	git := exec.CommandContext(ctx, "git", "rev-parse", "--short", "HEAD")
+	git.Dir = repo.Dir
+	commitb, err := git.Output()
+	if err != nil {
+		return false, err
+	}
+	repo.Commit = strings.TrimSuffix(string(commitb), "\n")
+
+	if err := repo.generateDoc(ctx, c, doc2go); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func newBuildContext(c *Config) (*buildContext, error) {
+	b := &buildContext{c: c, httpClient: newAPIClient(c)}
+	switch c.Provider {
+	case "", "github":
+		b.provider, b.token = githubProvider{}, c.GitHubToken
+	case "gitlab":
+		b.provider, b.token = gitlabProvider{}, c.GitLabToken
+	default:
+		return nil, fmt.Errorf("unknown provider %q: must be \"github\" or \"gitlab\"", c.Provider)
+	}
+
+	var err error
+	b.tpl, err = template.New("vanity").Funcs(template.FuncMap{
+		"contains":   strings.Contains,
+		"hasOnePkg":  b.hasOnePkg,
+		"importRoot": func() string { return c.ImportRoot },
+	}).ParseFS(tplFS, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// indexEntry is an entry of index.json, used for searching packages.
+type indexEntry struct {
+	ImportPath string `json:"import_path"`
+	Synopsis   string `json:"synopsis"`
+	URL        string `json:"url"`
+}
+
+// writeIndex writes index.json listing all public packages of repos.
+func writeIndex(path string, repos []*repo) error {
+	index := []indexEntry{}
+	for _, repo := range repos {
+		if repo.Private {
+			continue
+		}
+		for _, pkg := range repo.Pkgs {
+			if pkg.isInternal() {
+				continue
+			}
+			index = append(index, indexEntry{
+				ImportPath: pkg.ImportPath,
+				Synopsis:   pkg.Doc,
+				URL:        "/" + pkg.BasePath,
+			})
+		}
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
 func (b *buildContext) buildPage(path string, page *site.Page, tmpl string, data any) error {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return err
@@ -304,12 +447,76 @@ type repo struct {
 	CloneURL    string `json:"clone_url"`
 	Fork        bool   `json:"fork"`
 	Owner       *owner `json:"owner"`
+	// Stars, topics and last push date are shown on the index page.
+	StargazersCount int       `json:"stargazers_count"`
+	Topics          []string  `json:"topics"`
+	PushedAt        time.Time `json:"pushed_at"`
 	// Obtained by 'git rev-parse --short HEAD'
 	Commit string `json:"-"`
 	// For use with doc2go
 	Dir string `json:"-"`
 	// Go packages that this repo contains
 	Pkgs []*pkg `json:"-"`
+	// Host of the code hosting service, github.com if empty
+	host string
+}
+
+// sortRepos sorts repos according to Config.SortBy.
+func sortRepos(repos []*repo, by string) error {
+	switch by {
+	case "":
+	case "pushed":
+		slices.SortStableFunc(repos, func(a, b *repo) int { return b.PushedAt.Compare(a.PushedAt) })
+	case "stars":
+		slices.SortStableFunc(repos, func(a, b *repo) int { return cmp.Compare(b.StargazersCount, a.StargazersCount) })
+	default:
+		return fmt.Errorf("unknown sort order %q (want \"pushed\" or \"stars\")", by)
+	}
+	return nil
+}
+
+// pinRepos moves repos listed in Config.PinnedRepos to the beginning of repos,
+// preserving the order of others.
+func pinRepos(c *Config, repos []*repo) []*repo {
+	if len(c.PinnedRepos) == 0 {
+		return repos
+	}
+
+	var (
+		pinned = make([]*repo, 0, len(repos))
+		seen   = make(map[*repo]bool)
+	)
+	for _, name := range c.PinnedRepos {
+		i := slices.IndexFunc(repos, func(r *repo) bool { return r.Name == name })
+		if i == -1 {
+			c.Logf("Warning: pinned repository %q not found.", name)
+			continue
+		}
+		if seen[repos[i]] {
+			continue
+		}
+		seen[repos[i]] = true
+		pinned = append(pinned, repos[i])
+	}
+	for _, r := range repos {
+		if !seen[r] {
+			pinned = append(pinned, r)
+		}
+	}
+	return pinned
+}
+
+// WebURL returns the URL of the repository web page.
+func (r *repo) WebURL() string {
+	return "https://" + cmp.Or(r.host, "github.com") + "/" + r.Owner.Login + "/" + r.Name
+}
+
+// HostName returns the name of the code hosting service of the repository.
+func (r *repo) HostName() string {
+	if r.host == "gitlab.com" {
+		return "GitLab"
+	}
+	return "GitHub"
 }
 
 type owner struct {
@@ -331,41 +538,400 @@ type pkg struct {
 	Repo *repo
 }
 
-func makeRequest[Response any](ctx context.Context, c *Config, url string) (Response, error) {
+func (p *pkg) isInternal() bool {
+	return strings.Contains(p.BasePath, "internal")
+}
+
+// Siblings returns other non-internal packages in the same module, sorted by
+// import path.
+func (p *pkg) Siblings() []*pkg {
+	var sib []*pkg
+	for _, op := range p.Repo.Pkgs {
+		if op == p || op.ImportPath == p.ImportPath || op.isInternal() {
+			continue
+		}
+		sib = append(sib, op)
+	}
+	slices.SortFunc(sib, func(a, b *pkg) int { return strings.Compare(a.ImportPath, b.ImportPath) })
+	return sib
+}
+
+// moduleDirs returns directories of all modules in dir, including nested ones.
+func moduleDirs(dir string) ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// The go command ignores these directories too.
+			name := d.Name()
+			if path != dir && (name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == "go.mod" {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// listPackages runs "go list" for each module in the repository, since
+// "./..." pattern stops at nested module boundaries.
+func (r *repo) listPackages(ctx context.Context) error {
+	modDirs, err := moduleDirs(r.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range modDirs {
+		var obuf, errbuf bytes.Buffer
+		list := exec.CommandContext(ctx, "go", "list", "-json", "./...")
+		list.Dir = dir
+		list.Stdout = &obuf
+		list.Stderr = &errbuf
+		if err := list.Run(); err != nil {
+			return fmt.Errorf("go list failed for repo %s: %v (it returned %q)", r.Name, err, errbuf.String())
+		}
+
+		dec := json.NewDecoder(&obuf)
+		for dec.More() {
+			p := new(pkg)
+			if err := dec.Decode(p); err != nil {
+				return err
+			}
+			p.Repo = r
+			r.Pkgs = append(r.Pkgs, p)
+		}
+	}
+
+	return nil
+}
+
+// provider discovers repositories on a code hosting service.
+type provider interface {
+	// listRepos returns all repositories of the user.
+	listRepos(ctx context.Context, b *buildContext) ([]*repo, error)
+	// isGoModule reports whether r has go.mod at its root.
+	isGoModule(ctx context.Context, b *buildContext, r *repo) (bool, error)
+}
+
+// reposPerPage is the maximum number of repositories GitHub and GitLab APIs
+// return in a single response.
+const reposPerPage = 100
+
+// listPages requests pages of url from 1 until a partial one and returns
+// items from all of them.
+func listPages[Item any](ctx context.Context, b *buildContext, url string) ([]Item, error) {
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	var all []Item
+	for page := 1; ; page++ {
+		items, err := makeRequest[[]Item](ctx, b, fmt.Sprintf("%s%sper_page=%d&page=%d", url, sep, reposPerPage, page))
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+		if len(items) < reposPerPage {
+			return all, nil
+		}
+	}
+}
+
+// githubProvider discovers repositories with GitHub API.
+type githubProvider struct{}
+
+func (githubProvider) listRepos(ctx context.Context, b *buildContext) ([]*repo, error) {
+	return listPages[*repo](ctx, b, "https://api.github.com/user/repos")
+}
+
+func (githubProvider) isGoModule(ctx context.Context, b *buildContext, r *repo) (bool, error) {
+	files, err := makeRequest[[]file](ctx, b, r.URL+"/contents")
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(files, func(f file) bool { return f.Path == "go.mod" }), nil
+}
+
+const gitlabAPI = "https://gitlab.com/api/v4"
+
+// gitlabProvider discovers repositories with GitLab API.
+type gitlabProvider struct{}
+
+// gitlabProject is a project in GitLab API response.
+type gitlabProject struct {
+	ID             int       `json:"id"`
+	Path           string    `json:"path"`
+	Description    string    `json:"description"`
+	Visibility     string    `json:"visibility"`
+	Archived       bool      `json:"archived"`
+	HTTPURLToRepo  string    `json:"http_url_to_repo"`
+	ForkedFrom     *struct{} `json:"forked_from_project"`
+	StarCount      int       `json:"star_count"`
+	Topics         []string  `json:"topics"`
+	LastActivityAt time.Time `json:"last_activity_at"`
+	Namespace      struct {
+		FullPath string `json:"full_path"`
+	} `json:"namespace"`
+}
+
+func (gitlabProvider) listRepos(ctx context.Context, b *buildContext) ([]*repo, error) {
+	projects, err := listPages[gitlabProject](ctx, b, gitlabAPI+"/projects?owned=true")
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]*repo, 0, len(projects))
+	for _, p := range projects {
+		repos = append(repos, &repo{
+			Name:            p.Path,
+			URL:             fmt.Sprintf("%s/projects/%d", gitlabAPI, p.ID),
+			Private:         p.Visibility != "public",
+			Description:     p.Description,
+			Archived:        p.Archived,
+			CloneURL:        p.HTTPURLToRepo,
+			Fork:            p.ForkedFrom != nil,
+			Owner:           &owner{Login: p.Namespace.FullPath},
+			StargazersCount: p.StarCount,
+			Topics:          p.Topics,
+			PushedAt:        p.LastActivityAt,
+			host:            "gitlab.com",
+		})
+	}
+	return repos, nil
+}
+
+func (gitlabProvider) isGoModule(ctx context.Context, b *buildContext, r *repo) (bool, error) {
+	files, err := listPages[file](ctx, b, r.URL+"/repository/tree")
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(files, func(f file) bool { return f.Path == "go.mod" }), nil
+}
+
+func makeRequest[Response any](ctx context.Context, b *buildContext, url string) (Response, error) {
 	return request.Make[Response](ctx, request.Params{
 		Method: http.MethodGet,
 		URL:    url,
 		Headers: map[string]string{
-			"Authorization": "Bearer " + c.GitHubToken,
+			"Authorization": "Bearer " + b.token,
 		},
-		HTTPClient: c.HTTPClient,
+		HTTPClient: b.httpClient,
 	})
 }
 
+// newAPIClient returns a copy of c.HTTPClient, or of request.DefaultClient if
+// it's nil, that waits out rate limits and caches responses in c.CacheDir, if
+// set.
+func newAPIClient(c *Config) *http.Client {
+	client := cmp.Or(c.HTTPClient, request.DefaultClient)
+	var rt http.RoundTripper = http.DefaultTransport
+	if client.Transport != nil {
+		rt = client.Transport
+	}
+	rt = &rateLimitTransport{next: rt, logf: c.Logf}
+	if c.CacheDir != "" {
+		rt = &cachingTransport{dir: c.CacheDir, next: rt}
+	}
+	cc := *client
+	cc.Transport = rt
+	return &cc
+}
+
+const (
+	// maxRateLimitWait is the longest time to wait for a rate limit reset
+	// before giving up with RateLimitError.
+	maxRateLimitWait = 5 * time.Minute
+	// maxRateLimitRetries is how many times a rate limited request is retried.
+	maxRateLimitRetries = 3
+)
+
+// RateLimitError is returned when the provider API rate limit is exceeded and
+// it resets too late to wait for.
+type RateLimitError struct {
+	URL   string    // URL of the rate limited request
+	Reset time.Time // when the rate limit resets
+}
+
+func (e *RateLimitError) Error() string {
+	host := e.URL
+	if u, err := url.Parse(e.URL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return fmt.Sprintf("API rate limit of %s exceeded for %s, resets at %s", host, e.URL, e.Reset.Format(time.RFC3339))
+}
+
+// rateLimitTransport retries GET requests that hit provider API rate limits
+// after waiting until the reset time, if it's close enough.
+type rateLimitTransport struct {
+	next http.RoundTripper
+	logf logger.Logf
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for try := 0; ; try++ {
+		res, err := t.next.RoundTrip(req)
+		if err != nil || req.Method != http.MethodGet {
+			return res, err
+		}
+		reset, limited := rateLimitReset(res, time.Now())
+		if !limited {
+			return res, nil
+		}
+		res.Body.Close()
+
+		wait := time.Until(reset)
+		if try == maxRateLimitRetries || wait > maxRateLimitWait {
+			return nil, &RateLimitError{URL: req.URL.String(), Reset: reset}
+		}
+		if wait > 0 {
+			t.logf("API rate limit of %s exceeded, waiting %s until it resets.", req.URL.Host, wait.Round(time.Second))
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// rateLimitReset reports whether res is a rate limit response from the API
+// and when the limit resets, based on Retry-After or X-RateLimit-Reset
+// headers.
+func rateLimitReset(res *http.Response, now time.Time) (reset time.Time, limited bool) {
+	if res.StatusCode != http.StatusForbidden && res.StatusCode != http.StatusTooManyRequests {
+		return time.Time{}, false
+	}
+	if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		return now.Add(time.Duration(secs) * time.Second), true
+	}
+	if res.Header.Get("X-RateLimit-Remaining") != "0" {
+		return time.Time{}, false
+	}
+	// Without reset time, wait a minute like GitHub recommends.
+	reset = now.Add(time.Minute)
+	if unix, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		reset = time.Unix(unix, 0)
+	}
+	return reset, true
+}
+
+// cachingTransport caches successful GET responses with ETag on disk, keyed by
+// URL and a fingerprint of credentials, and revalidates them with
+// If-None-Match. A 304 Not Modified response is replaced with the cached one.
+// Responses may contain private data, so the cache is readable only by the
+// current user.
+type cachingTransport struct {
+	dir  string
+	next http.RoundTripper
+}
+
+// cachedResponse is a response stored by cachingTransport.
+type cachedResponse struct {
+	ETag   string      `json:"etag"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.next.RoundTrip(req)
+	}
+
+	// Responses depend on the token, e.g. with private repositories, so
+	// don't share them between tokens. Only the hash is stored, not the token.
+	sum := sha256.Sum256([]byte(req.URL.String() + "\x00" + req.Header.Get("Authorization")))
+	path := filepath.Join(t.dir, hex.EncodeToString(sum[:])+".json")
+
+	var cached *cachedResponse
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &cached); err != nil {
+			cached = nil // corrupted, so refetch
+		}
+	}
+	if cached != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotModified && cached != nil:
+		res.Body.Close()
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         res.Proto,
+			ProtoMajor:    res.ProtoMajor,
+			ProtoMinor:    res.ProtoMinor,
+			Header:        cached.Header,
+			Body:          io.NopCloser(bytes.NewReader(cached.Body)),
+			ContentLength: int64(len(cached.Body)),
+			Request:       req,
+		}, nil
+	case res.StatusCode == http.StatusOK && res.Header.Get("ETag") != "":
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(&cachedResponse{ETag: res.Header.Get("ETag"), Header: res.Header, Body: body})
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(t.dir, 0o700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			return nil, err
+		}
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		return res, nil
+	}
+	return res, nil
+}
+
 type file struct {
 	Path string `json:"path"`
 }
 
-func (r *repo) generateDoc(c *Config, doc2goBin string) error {
+func (r *repo) generateDoc(ctx context.Context, c *Config, doc2goBin string) error {
 	tmpdir, err := os.MkdirTemp("", "vanity-doc2go")
 	if err != nil {
 		return err
 	}
 	defer os.RemoveAll(tmpdir)
 
-	doc2go := exec.Command(
-		doc2goBin,
-		"-highlight",
-		"classes:"+highlightTheme,
-		"-pkg-doc", path.Join(c.ImportRoot, r.Name)+"=https://{{ .ImportPath }}",
-		"-embed", "-out", tmpdir,
-		"./...",
-	)
-	doc2go.Stderr = c.Logf
-	doc2go.Dir = r.Dir
-	if err := doc2go.Run(); err != nil {
+	// Run doc2go for each module, as "./..." pattern doesn't cross nested
+	// module boundaries.
+	modDirs, err := moduleDirs(r.Dir)
+	if err != nil {
 		return err
 	}
+	for _, dir := range modDirs {
+		doc2go := exec.CommandContext(
+			ctx,
+			doc2goBin,
+			"-highlight",
+			"classes:"+highlightTheme,
+			"-pkg-doc", path.Join(c.ImportRoot, r.Name)+"=https://{{ .ImportPath }}",
+			"-embed", "-out", tmpdir,
+			"./...",
+		)
+		doc2go.Stderr = c.Logf
+		doc2go.Dir = dir
+		if err := doc2go.Run(); err != nil {
+			return err
+		}
+	}
 
 	// If we don't have a package which import path equals the module path
 	// (e.g. for github.com/astrophena/go-testrepo module there's no package
@@ -391,7 +957,7 @@ func (r *repo) generateDoc(c *Config, doc2goBin string) error {
 
 		docfile := filepath.Join(tmpdir, pkg.ImportPath, "index.html")
 		if _, err := os.Stat(docfile); errors.Is(err, fs.ErrNotExist) {
-			return nil
+			continue
 		} else if err != nil {
 			return err
 		}
@@ -475,7 +1041,7 @@ func linkFragment(link string) (path string, fragment string) {
 
 func metaTagsForRepo(c *Config, r *repo) map[string]string {
 	return map[string]string{
-		"go-import": fmt.Sprintf("%[1]s/%[2]s git https://github.com/%[3]s/%[2]s", c.ImportRoot, r.Name, r.Owner.Login),
+		"go-import": fmt.Sprintf("%s/%s git %s", c.ImportRoot, r.Name, r.WebURL()),
 	}
 }
 
@@ -5,20 +5,27 @@
 package vanity
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"go.astrophena.name/base/testutil"
+	"go.astrophena.name/base/txtar"
 )
 
 const githubToken = "superdupersecret"
@@ -60,6 +67,15 @@ var repos = []repo{
 		CloneURL:    filepath.Join("vanity", "testdata", "base.bundle"),
 		Owner:       &owner{Login: "example"},
 	},
+	{
+		Name:        "nested",
+		URL:         "https://api.github.com/repos/example/nested",
+		Private:     false,
+		Description: "Module with a nested module.",
+		Archived:    false,
+		CloneURL:    filepath.Join("vanity", "testdata", "nested.bundle"),
+		Owner:       &owner{Login: "example"},
+	},
 }
 
 // TODO: maybe generate this from Git bundle?
@@ -83,9 +99,19 @@ var filesForRepo = map[string][]file{
 		{Path: "testutil/testutil.go"},
 		{Path: "txtar/txtar.go"},
 	},
+	"nested": []file{
+		{Path: "go.mod"},
+		{Path: "nested.go"},
+		{Path: "sub/go.mod"},
+		{Path: "sub/inner/inner.go"},
+		{Path: "sub/sub.go"},
+	},
 }
 
-var inspect = flag.Bool("inspect", false, "print location of test site for inspection")
+var (
+	inspect = flag.Bool("inspect", false, "print location of test site for inspection")
+	update  = flag.Bool("update", false, "update golden files in testdata")
+)
 
 func TestMain(m *testing.M) {
 	if err := os.Chdir(".."); err != nil {
@@ -125,15 +151,504 @@ func TestBuild(t *testing.T) {
 		"index.html",
 		"css/godoc.css",
 		"css/main.css",
+		"index.json",
+		"js/search.js",
+		"nested.html",
+		"nested/sub.html",
+		"nested/sub/inner.html",
 	} {
 		wantFile(t, filepath.Join(dir, f))
 	}
 
+	// Check search.
+	index, err := os.ReadFile(filepath.Join(dir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`id="search"`, `<script defer src="/js/search.js"></script>`} {
+		if !strings.Contains(string(index), want) {
+			t.Errorf("index.html doesn't contain %s", want)
+		}
+	}
+	searchJS, err := os.ReadFile(filepath.Join(dir, "js", "search.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(searchJS), "/index.json") {
+		t.Errorf("search.js doesn't reference index.json")
+	}
+	indexJSON, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := testutil.UnmarshalJSON[[]indexEntry](t, indexJSON)
+	testutil.AssertContains(t, entries, indexEntry{
+		ImportPath: "example.com/base/txtar",
+		Synopsis:   "Package txtar implements a trivial text-based file archive format.",
+		URL:        "/base/txtar",
+	})
+
 	if *inspect {
 		fmt.Fprintf(os.Stderr, "%s\n", dir)
 	}
 }
 
+// commitRe matches abbreviated commit hashes in links to commits.
+var commitRe = regexp.MustCompile(`/commit/[0-9a-f]+">Commit \([0-9a-f]+\)`)
+
+func TestBuildGolden(t *testing.T) {
+	testutil.RunGolden(t, "vanity/testdata/golden/*.json", func(t *testing.T, match string) []byte {
+		dir := t.TempDir()
+		if err := Build(context.Background(), &Config{
+			Dir:        dir,
+			Logf:       t.Logf,
+			ImportRoot: "example.com",
+			ReposFile:  match,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Keep only generated files, static ones are copied from the main site.
+		ar := new(txtar.Archive)
+		if err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ext := filepath.Ext(p); d.IsDir() || (ext != ".html" && ext != ".json") {
+				return nil
+			}
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			ar.Files = append(ar.Files, txtar.File{
+				Name: filepath.ToSlash(rel),
+				Data: commitRe.ReplaceAll(data, []byte(`/commit/COMMIT">Commit (COMMIT)`)),
+			})
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return txtar.Format(ar)
+	}, *update)
+}
+
+func TestBuildReposFile(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := json.Marshal(repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reposFile := filepath.Join(t.TempDir(), "repos.json")
+	if err := os.WriteFile(reposFile, j, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{
+		Dir:        dir,
+		Logf:       t.Logf,
+		ImportRoot: "example.com",
+		ReposFile:  reposFile,
+		HTTPClient: testutil.MockHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("unexpected request to %s", r.URL)
+			http.NotFound(w, r)
+		})),
+	}
+	if err := Build(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{
+		"index.html",
+		"base.html",
+		"base/txtar.html",
+		"nothing.html",
+	} {
+		wantFile(t, filepath.Join(dir, f))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nogomod.html")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("nogomod.html should not exist, got %v", err)
+	}
+}
+
+func TestBuildConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{
+		Dir:         dir,
+		GitHubToken: githubToken,
+		Logf:        t.Logf,
+		ImportRoot:  "example.com",
+		HTTPClient:  testutil.MockHTTPClient(testHandler(t)),
+		Concurrency: len(repos),
+	}
+	if err := Build(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{
+		"base.html",
+		"base/txtar.html",
+		"nested.html",
+		"nested/sub.html",
+		"noroot.html",
+		"nothing.html",
+	} {
+		wantFile(t, filepath.Join(dir, f))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nogomod.html")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("nogomod.html should not exist, got %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Run("recovers", func(t *testing.T) {
+		var limited atomic.Bool
+		api := testHandler(t)
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/user/repos" && limited.CompareAndSwap(false, true) {
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.Header().Set("X-RateLimit-Reset", fmt.Sprint(time.Now().Unix()))
+				http.Error(w, "API rate limit exceeded", http.StatusForbidden)
+				return
+			}
+			api.ServeHTTP(w, r)
+		})
+
+		dir := t.TempDir()
+		if err := Build(context.Background(), &Config{
+			Dir:         dir,
+			GitHubToken: githubToken,
+			Logf:        t.Logf,
+			ImportRoot:  "example.com",
+			HTTPClient:  testutil.MockHTTPClient(handler),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !limited.Load() {
+			t.Fatal("rate limit response was not sent")
+		}
+		wantFile(t, filepath.Join(dir, "base.html"))
+	})
+
+	t.Run("resets too late", func(t *testing.T) {
+		reset := time.Now().Add(time.Hour).Truncate(time.Second)
+		b, err := newBuildContext(&Config{
+			GitHubToken: githubToken,
+			Logf:        t.Logf,
+			HTTPClient: testutil.MockHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.Header().Set("X-RateLimit-Reset", fmt.Sprint(reset.Unix()))
+				http.Error(w, "API rate limit exceeded", http.StatusForbidden)
+			})),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = githubProvider{}.listRepos(context.Background(), b)
+		var rlErr *RateLimitError
+		if !errors.As(err, &rlErr) {
+			t.Fatalf("want RateLimitError, got %v", err)
+		}
+		if !rlErr.Reset.Equal(reset) {
+			t.Errorf("got reset time %v, want %v", rlErr.Reset, reset)
+		}
+		if want := "API rate limit of api.github.com exceeded"; !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't contain %q", err, want)
+		}
+	})
+}
+
+func TestBuildCache(t *testing.T) {
+	var notModified atomic.Int32
+	contents := testHandler(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/contents") {
+			contents.ServeHTTP(w, r)
+			return
+		}
+		etag := `"` + r.URL.Path + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		contents.ServeHTTP(w, r)
+	})
+
+	c := &Config{
+		GitHubToken: githubToken,
+		Logf:        t.Logf,
+		ImportRoot:  "example.com",
+		HTTPClient:  testutil.MockHTTPClient(handler),
+		CacheDir:    t.TempDir(),
+	}
+	for range 2 {
+		c.Dir = t.TempDir()
+		if err := Build(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second build used cached contents to detect Go modules.
+	if notModified.Load() == 0 {
+		t.Error("cached responses were not revalidated")
+	}
+	wantFile(t, filepath.Join(c.Dir, "base.html"))
+	wantFile(t, filepath.Join(c.Dir, "nothing.html"))
+}
+
+func TestCachingTransport(t *testing.T) {
+	var revalidated []string // tokens of requests with If-None-Match
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidated = append(revalidated, r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "private")
+	})
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	client := &http.Client{Transport: &cachingTransport{dir: dir, next: testutil.MockHTTPClient(handler).Transport}}
+	get := func(token string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "https://api.github.com/user/repos", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.AssertEqual(t, string(body), "private")
+	}
+
+	get("alice")
+	get("alice")
+	get("bob")
+	testutil.AssertEqual(t, revalidated, []string{"Bearer alice"})
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertEqual(t, fi.Mode().Perm(), fs.FileMode(0o700))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("want a cache entry per token, got %v", entries)
+	}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.AssertEqual(t, fi.Mode().Perm(), fs.FileMode(0o600))
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte("alice")) || bytes.Contains(b, []byte("bob")) {
+			t.Errorf("cache entry %s contains a token:\n%s", e.Name(), b)
+		}
+	}
+}
+
+func TestIncludeArchived(t *testing.T) {
+	archived := append([]repo(nil), repos...)
+	for i := range archived {
+		archived[i].Archived = archived[i].Name == "nothing"
+	}
+	j, err := json.Marshal(archived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reposFile := filepath.Join(t.TempDir(), "repos.json")
+	if err := os.WriteFile(reposFile, j, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, include := range []bool{false, true} {
+		t.Run(fmt.Sprintf("include=%v", include), func(t *testing.T) {
+			dir := t.TempDir()
+			if err := Build(context.Background(), &Config{
+				Dir:             dir,
+				Logf:            t.Logf,
+				ImportRoot:      "example.com",
+				ReposFile:       reposFile,
+				IncludeArchived: include,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			index, err := os.ReadFile(filepath.Join(dir, "index.html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(string(index), `<a href="/nothing">nothing</a>`); got != include {
+				t.Errorf("archived repo listed: %v, want %v", got, include)
+			}
+			if got := strings.Contains(string(index), `<span class="module archived">Archived</span>`); got != include {
+				t.Errorf("archived badge shown: %v, want %v", got, include)
+			}
+			// Other repos are listed either way.
+			if !strings.Contains(string(index), `<a href="/base">base</a>`) {
+				t.Error("base repo is not listed")
+			}
+		})
+	}
+}
+
+func TestBranches(t *testing.T) {
+	j, err := json.Marshal([]repo{{
+		Name:        "branches",
+		Description: "Documented on a branch.",
+		CloneURL:    filepath.Join("vanity", "testdata", "branches.bundle"),
+		Owner:       &owner{Login: "example"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reposFile := filepath.Join(t.TempDir(), "repos.json")
+	if err := os.WriteFile(reposFile, j, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		branches map[string]string
+		want     string
+	}{
+		{branches: nil, want: "documented on the default branch"},
+		{branches: map[string]string{"branches": "docs"}, want: "documented on the docs branch"},
+	} {
+		t.Run(tc.want, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := Build(context.Background(), &Config{
+				Dir:        dir,
+				Logf:       t.Logf,
+				ImportRoot: "example.com",
+				ReposFile:  reposFile,
+				Branches:   tc.branches,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			page, err := os.ReadFile(filepath.Join(dir, "branches.html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(page), tc.want) {
+				t.Errorf("branches.html doesn't contain %q", tc.want)
+			}
+		})
+	}
+}
+
+func TestGoImportMetaTags(t *testing.T) {
+	withInternal := repo{
+		Name:        "withinternal",
+		Description: "Module with an internal nested module.",
+		CloneURL:    filepath.Join("vanity", "testdata", "withinternal.bundle"),
+		Owner:       &owner{Login: "example"},
+	}
+	j, err := json.Marshal(append(repos, withInternal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reposFile := filepath.Join(t.TempDir(), "repos.json")
+	if err := os.WriteFile(reposFile, j, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := Build(context.Background(), &Config{
+		Dir:        dir,
+		Logf:       t.Logf,
+		ImportRoot: "example.com",
+		ReposFile:  reposFile,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for page, want := range map[string]string{
+		"base/txtar.html":                 "example.com/base git https://github.com/example/base",
+		"nested/sub/inner.html":           "example.com/nested git https://github.com/example/nested",
+		"noroot.html":                     "example.com/noroot git https://github.com/example/noroot",
+		"withinternal/internal/tool.html": "example.com/withinternal git https://github.com/example/withinternal",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag := `<meta name="go-import" content="` + want + `">`; !strings.Contains(string(got), tag) {
+			t.Errorf("%s doesn't contain %s", page, tag)
+		}
+	}
+}
+
+func TestGitLab(t *testing.T) {
+	const gitlabToken = "gitlabsecret"
+	mux := http.NewServeMux()
+	mux.HandleFunc("gitlab.com/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		testutil.AssertEqual(t, r.Header.Get("Authorization"), "Bearer "+gitlabToken)
+		testutil.AssertEqual(t, r.URL.Query().Get("owned"), "true")
+		respondJSON(t, w, []map[string]any{{
+			"id":               42,
+			"path":             "nothing",
+			"description":      "Package nothing does nothing.",
+			"visibility":       "public",
+			"http_url_to_repo": filepath.Join("vanity", "testdata", "nothing.bundle"),
+			"namespace":        map[string]any{"full_path": "example"},
+		}})
+	})
+	mux.HandleFunc("gitlab.com/api/v4/projects/42/repository/tree", func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(t, w, filesForRepo["nothing"])
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL)
+		http.NotFound(w, r)
+	})
+
+	dir := t.TempDir()
+	if err := Build(context.Background(), &Config{
+		Dir:         dir,
+		Provider:    "gitlab",
+		GitLabToken: gitlabToken,
+		Logf:        t.Logf,
+		ImportRoot:  "example.com",
+		HTTPClient:  testutil.MockHTTPClient(mux),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := os.ReadFile(filepath.Join(dir, "nothing.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<meta name="go-import" content="example.com/nothing git https://gitlab.com/example/nothing">`,
+		`<a href="https://gitlab.com/example/nothing">GitLab repository</a>`,
+	} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("nothing.html doesn't contain %s", want)
+		}
+	}
+}
+
 func wantFile(t *testing.T, path string) {
 	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
 		t.Errorf("file %q doesn't exist", path)
@@ -170,6 +685,43 @@ func respondJSON(t *testing.T, w http.ResponseWriter, data any) {
 	w.Write(j)
 }
 
+func TestListReposPagination(t *testing.T) {
+	// The first page is full, so the second one is requested.
+	var first []repo
+	for i := range reposPerPage {
+		first = append(first, repo{Name: fmt.Sprintf("repo%d", i)})
+	}
+	second := []repo{{Name: "last"}}
+
+	c := &Config{
+		GitHubToken: githubToken,
+		Logf:        t.Logf,
+		HTTPClient: testutil.MockHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			testutil.AssertEqual(t, r.URL.Query().Get("per_page"), fmt.Sprint(reposPerPage))
+			switch r.URL.Query().Get("page") {
+			case "1":
+				respondJSON(t, w, first)
+			case "2":
+				respondJSON(t, w, second)
+			default:
+				t.Errorf("unexpected request for page %q", r.URL.Query().Get("page"))
+				http.NotFound(w, r)
+			}
+		})),
+	}
+	b, err := newBuildContext(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := githubProvider{}.listRepos(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertEqual(t, len(got), reposPerPage+1)
+	testutil.AssertEqual(t, got[0].Name, "repo0")
+	testutil.AssertEqual(t, got[len(got)-1].Name, "last")
+}
+
 func TestReplaceRelLinks(t *testing.T) {
 	c := &Config{
 		ImportRoot: "go.astrophena.name",
@@ -267,3 +819,171 @@ func TestReplaceRelLinks(t *testing.T) {
 		})
 	}
 }
+
+func TestSiblings(t *testing.T) {
+	b, err := newBuildContext(&Config{ImportRoot: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &repo{Name: "base", Owner: &owner{Login: "example"}}
+	for _, path := range []string{"base", "base/txtar", "base/testutil", "base/internal/lib"} {
+		r.Pkgs = append(r.Pkgs, &pkg{
+			ImportPath: "example.com/" + path,
+			BasePath:   path,
+			Repo:       r,
+		})
+	}
+
+	var buf strings.Builder
+	if err := b.tpl.ExecuteTemplate(&buf, "pkg", r.Pkgs[1]); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+
+	for _, want := range []string{
+		"Other packages in this module",
+		`<a href="/base">example.com/base</a>`,
+		`<a href="/base/testutil">example.com/base/testutil</a>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want %s in output:\n%s", want, got)
+		}
+	}
+	for _, dontWant := range []string{
+		`<a href="/base/txtar">`,
+		`<a href="/base/internal/lib">`,
+	} {
+		if strings.Contains(got, dontWant) {
+			t.Errorf("don't want %s in output:\n%s", dontWant, got)
+		}
+	}
+	if strings.Index(got, `href="/base/testutil"`) < strings.Index(got, `href="/base"`) {
+		t.Errorf("siblings must be sorted by import path:\n%s", got)
+	}
+}
+
+func TestRepoMetadata(t *testing.T) {
+	const resp = `[
+  {
+    "name": "old",
+    "owner": {"login": "example"},
+    "stargazers_count": 10,
+    "topics": ["go", "cli"],
+    "pushed_at": "2022-02-14T10:00:00Z"
+  },
+  {
+    "name": "new",
+    "owner": {"login": "example"},
+    "stargazers_count": 1,
+    "pushed_at": "2024-03-10T10:00:00Z"
+  },
+  {
+    "name": "mid",
+    "owner": {"login": "example"},
+    "stargazers_count": 5,
+    "pushed_at": "2023-05-20T10:00:00Z"
+  }
+]`
+
+	b, err := newBuildContext(&Config{ImportRoot: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		sortBy    string
+		wantOrder []string
+	}{
+		"default": {wantOrder: []string{"old", "new", "mid"}},
+		"pushed":  {sortBy: "pushed", wantOrder: []string{"new", "mid", "old"}},
+		"stars":   {sortBy: "stars", wantOrder: []string{"old", "mid", "new"}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			repos := testutil.UnmarshalJSON[[]*repo](t, []byte(resp))
+			if err := sortRepos(repos, tc.sortBy); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf strings.Builder
+			if err := b.tpl.ExecuteTemplate(&buf, "index", repos); err != nil {
+				t.Fatal(err)
+			}
+			got := buf.String()
+
+			for _, want := range []string{
+				"10 stars",
+				"1 star\n",
+				"Last pushed on February 14, 2022",
+				"Last pushed on March 10, 2024",
+				`<span class="topic">go</span> <span class="topic">cli</span>`,
+			} {
+				if !strings.Contains(got, want) {
+					t.Errorf("want %q in output:\n%s", want, got)
+				}
+			}
+
+			prev := -1
+			for _, name := range tc.wantOrder {
+				i := strings.Index(got, `href="/`+name+`"`)
+				if i == -1 || i < prev {
+					t.Fatalf("want order %v, got:\n%s", tc.wantOrder, got)
+				}
+				prev = i
+			}
+		})
+	}
+
+	if err := sortRepos(nil, "forks"); err == nil {
+		t.Fatal("sortRepos must fail for unknown sort order")
+	}
+}
+
+func TestPinRepos(t *testing.T) {
+	var logs []string
+	c := &Config{
+		PinnedRepos: []string{"c", "missing", "b"},
+		Logf: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+
+	var repos []*repo
+	for _, name := range []string{"a", "b", "c", "d"} {
+		repos = append(repos, &repo{Name: name})
+	}
+
+	var got []string
+	for _, r := range pinRepos(c, repos) {
+		got = append(got, r.Name)
+	}
+	testutil.AssertEqual(t, got, []string{"c", "b", "a", "d"})
+	testutil.AssertEqual(t, logs, []string{`Warning: pinned repository "missing" not found.`})
+}
+
+func TestListPackages(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nested")
+	clone := exec.Command("git", "clone", filepath.Join("vanity", "testdata", "nested.bundle"), dir)
+	if out, err := clone.CombinedOutput(); err != nil {
+		t.Fatalf("git clone failed: %v (%s)", err, out)
+	}
+
+	r := &repo{Name: "nested", Dir: dir}
+	if err := r.listPackages(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range r.Pkgs {
+		got = append(got, p.ImportPath)
+		if p.Repo != r {
+			t.Errorf("package %s doesn't point to its repo", p.ImportPath)
+		}
+	}
+	testutil.AssertEqual(t, got, []string{
+		"example.com/nested",
+		"example.com/nested/sub",
+		"example.com/nested/sub/inner",
+	})
+}